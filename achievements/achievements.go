@@ -0,0 +1,257 @@
+// Package achievements grants students badges for milestones in the house cup, such as their first
+// points or a week of steady awards. Achievements are defined by rules read from a JSON config file and
+// evaluated after each award, in the transaction that appends it; a student earns each achievement once.
+package achievements
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/gambinish/house-cup/models"
+)
+
+// Kinds of rules.
+const (
+	// PointsTotal is earned when a student's points total reaches Threshold.
+	PointsTotal = "points_total"
+	// AwardCount is earned with Threshold awards, not since reversed, within the last Window_Days days.
+	AwardCount = "award_count"
+	// HouseLeader is earned by the student who earned the most points for their house within the last Window_Days days,
+	// ahead of every other student of the house and with at least Threshold points.
+	HouseLeader = "house_leader"
+)
+
+// Kinds lists every kind of rule.
+var Kinds = []string{PointsTotal, AwardCount, HouseLeader}
+
+// KnownKind reports whether kind is one of Kinds.
+func KnownKind(kind string) bool {
+	for _, known := range Kinds {
+		if known == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule defines an achievement. A Window_Days of 0 looks at every record.
+type Rule struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Kind        string `json:"kind"`
+	Threshold   int64  `json:"threshold"`
+	Window_Days int    `json:"window_days"`
+}
+
+// Engine evaluates a set of rules.
+type Engine struct {
+	rules []Rule
+}
+
+// Default is the engine shared by the handlers of the application. It has no rules until they are loaded.
+var Default = &Engine{}
+
+// Load replaces the rules of e with the JSON array of rules in the file at path.
+func (e *Engine) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("achievements: %w", err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("achievements: %s: %w", path, err)
+	}
+	if err := validate(rules); err != nil {
+		return fmt.Errorf("achievements: %s: %w", path, err)
+	}
+	e.rules = rules
+	return nil
+}
+
+// validate checks that every rule has a unique key that fits the Achievement_Key column, a name and a known kind.
+func validate(rules []Rule) error {
+	keys := map[string]bool{}
+	for i, rule := range rules {
+		switch {
+		case rule.Key == "" || len(rule.Key) > 64:
+			return fmt.Errorf("rule %d: key must be between 1 and 64 characters", i)
+		case keys[rule.Key]:
+			return fmt.Errorf("rule %q: duplicate key", rule.Key)
+		case rule.Name == "":
+			return fmt.Errorf("rule %q: name is required", rule.Key)
+		case !KnownKind(rule.Kind):
+			return fmt.Errorf("rule %q: unknown kind %q", rule.Key, rule.Kind)
+		case rule.Threshold < 0 || rule.Window_Days < 0:
+			return fmt.Errorf("rule %q: threshold and window_days must not be negative", rule.Key)
+		}
+		keys[rule.Key] = true
+	}
+	return nil
+}
+
+// Rules returns the rules of e, in the order they were defined.
+func (e *Engine) Rules() []Rule {
+	return append([]Rule(nil), e.rules...)
+}
+
+// Evaluate grants within tx the achievements that the students awarded points records have earned and not yet been granted.
+// Each achievement records the first of those records its student was awarded. It returns the new achievements.
+func (e *Engine) Evaluate(tx *sql.Tx, points []models.Point) ([]models.Achievement, error) {
+	if len(e.rules) == 0 {
+		return nil, nil
+	}
+
+	pointIDs := map[int64]int64{}
+	var studentIDs []int64
+	for _, point := range points {
+		if point.Student_ID == nil {
+			continue
+		}
+		if _, ok := pointIDs[*point.Student_ID]; !ok {
+			pointIDs[*point.Student_ID] = point.ID
+			studentIDs = append(studentIDs, *point.Student_ID)
+		}
+	}
+	sort.Slice(studentIDs, func(i, j int) bool { return studentIDs[i] < studentIDs[j] })
+
+	var granted []models.Achievement
+	for _, studentID := range studentIDs {
+		held, err := heldKeys(tx, studentID)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range e.rules {
+			if held[rule.Key] {
+				continue
+			}
+			earned, err := rule.earned(tx, studentID)
+			if err != nil {
+				return nil, fmt.Errorf("achievement %q: %w", rule.Key, err)
+			}
+			if !earned {
+				continue
+			}
+			achievement, inserted, err := grant(tx, rule, studentID, pointIDs[studentID])
+			if err != nil {
+				return nil, err
+			}
+			if inserted {
+				granted = append(granted, achievement)
+			}
+		}
+	}
+	return granted, nil
+}
+
+// heldKeys returns the keys of the achievements a student was granted.
+func heldKeys(tx *sql.Tx, studentID int64) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT Achievement_Key FROM Student_Achievements WHERE Student_ID = ?", studentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := map[string]bool{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		held[key] = true
+	}
+	return held, rows.Err()
+}
+
+// earned reports whether a student meets the rule.
+func (r Rule) earned(tx *sql.Tx, studentID int64) (bool, error) {
+	switch r.Kind {
+	case PointsTotal:
+		var total int64
+		err := tx.QueryRow("SELECT Points FROM Students WHERE ID = ?", studentID).Scan(&total)
+		return total >= r.Threshold, err
+
+	case AwardCount:
+		var count int64
+		err := tx.QueryRow(`SELECT COUNT(*) FROM Points
+							LEFT JOIN Points AS Reversals ON Reversals.Reverses_ID = Points.ID
+							WHERE Points.Student_ID = ? AND Points.Kind = 'award' AND Reversals.ID IS NULL
+								AND (? = 0 OR Points.Created_At > CURRENT_TIMESTAMP - INTERVAL ? DAY)`,
+			studentID, r.Window_Days, r.Window_Days).Scan(&count)
+		return count >= r.Threshold, err
+
+	case HouseLeader:
+		// Rank the students of the student's house by the points they earned for it within the window
+		rows, err := tx.Query(`SELECT Points.Student_ID, SUM(Points.Points) AS Earned
+								FROM Points
+								JOIN Students AS Student ON Student.ID = ?
+								JOIN Students ON Students.ID = Points.Student_ID AND Students.Deleted_At IS NULL
+								WHERE Points.House_ID = Student.House_ID
+									AND (? = 0 OR Points.Created_At > CURRENT_TIMESTAMP - INTERVAL ? DAY)
+								GROUP BY Points.Student_ID
+								ORDER BY Earned DESC, Points.Student_ID
+								LIMIT 2`, studentID, r.Window_Days, r.Window_Days)
+		if err != nil {
+			return false, err
+		}
+		defer rows.Close()
+
+		var leaders [][2]int64
+		for rows.Next() {
+			var leader [2]int64
+			if err := rows.Scan(&leader[0], &leader[1]); err != nil {
+				return false, err
+			}
+			leaders = append(leaders, leader)
+		}
+		if err := rows.Err(); err != nil {
+			return false, err
+		}
+		if len(leaders) == 0 || leaders[0][0] != studentID || leaders[0][1] <= 0 || leaders[0][1] < r.Threshold {
+			return false, nil
+		}
+		// A tie for the lead does not count
+		return len(leaders) == 1 || leaders[1][1] < leaders[0][1], nil
+	}
+	return false, fmt.Errorf("unknown kind %q", r.Kind)
+}
+
+// grant records that a student earned the achievement defined by rule with the points record identified by pointID.
+// It reports false, without an error, when a concurrent award granted the achievement first.
+func grant(tx *sql.Tx, rule Rule, studentID int64, pointID int64) (models.Achievement, bool, error) {
+	result, err := tx.Exec(`INSERT INTO Student_Achievements (Student_ID, Achievement_Key, Achievement_Name, Point_ID) VALUES (?, ?, ?, ?)
+							ON DUPLICATE KEY UPDATE ID = ID`, studentID, rule.Key, rule.Name, pointID)
+	if err != nil {
+		return models.Achievement{}, false, err
+	}
+	// A duplicate leaves the existing row unchanged, which reports no affected rows
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return models.Achievement{}, false, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return models.Achievement{}, false, err
+	}
+	achievement, err := lookup(tx, id)
+	return achievement, err == nil, err
+}
+
+// Columns lists the Student_Achievements columns in the order Scan reads them.
+const Columns = "ID, Student_ID, Achievement_Key, Achievement_Name, Point_ID, Granted_At"
+
+// Scan reads a row of Columns.
+func Scan(row interface{ Scan(...interface{}) error }) (models.Achievement, error) {
+	var achievement models.Achievement
+	err := row.Scan(&achievement.ID, &achievement.Student_ID, &achievement.Achievement_Key, &achievement.Achievement_Name,
+		&achievement.Point_ID, &achievement.Granted_At)
+	return achievement, err
+}
+
+// lookup returns the achievement identified by id.
+func lookup(tx *sql.Tx, id int64) (models.Achievement, error) {
+	return Scan(tx.QueryRow("SELECT "+Columns+" FROM Student_Achievements WHERE ID = ?", id))
+}
@@ -0,0 +1,155 @@
+// Package audit records every change made to the house-cup data in the append-only Audit_Log table,
+// with who made it, the request it belonged to and the affected row before and after the change.
+package audit
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ActorKey is the gin context key under which a handler may name the actor of its request,
+// such as the chat user behind a slash command, instead of the X-Actor header.
+const ActorKey = "audit.actor"
+
+// Anonymous is the actor of requests that do not name one.
+const Anonymous = "anonymous"
+
+// redactedColumns are never copied into a snapshot.
+var redactedColumns = map[string]bool{"secret": true}
+
+// Entry is one audited change. Before and After hold JSON snapshots of the affected row and are nil
+// when it did not exist, such as before a create or after a delete.
+type Entry struct {
+	Request_ID  string
+	Actor       string
+	Action      string
+	Method      string
+	Path        string
+	Entity      string
+	Entity_ID   string
+	Status_Code int
+	Before      json.RawMessage
+	After       json.RawMessage
+	Client_IP   string
+}
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Execer is satisfied by both *sql.DB and *sql.Tx.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	return hex.EncodeToString(random)
+}
+
+// Write appends an entry to the audit log.
+func Write(e Execer, entry Entry) error {
+	var entityID interface{}
+	if entry.Entity_ID != "" {
+		entityID = entry.Entity_ID
+	}
+	if entry.Actor == "" {
+		entry.Actor = Anonymous
+	}
+	_, err := e.Exec(`INSERT INTO Audit_Log (Request_ID, Actor, Action, Method, Path, Entity, Entity_ID, Status_Code, Before_JSON, After_JSON, Client_IP)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Request_ID, entry.Actor, entry.Action, entry.Method, entry.Path, entry.Entity, entityID, entry.Status_Code,
+		nullableJSON(entry.Before), nullableJSON(entry.After), entry.Client_IP)
+	return err
+}
+
+func nullableJSON(value json.RawMessage) interface{} {
+	if len(value) == 0 {
+		return nil
+	}
+	return string(value)
+}
+
+// Snapshot returns the row of table whose column equals value as a JSON object keyed by lowercase column names,
+// the way the API names fields, or nil when there is no such row. Secrets are left out.
+func Snapshot(q Querier, table string, column string, value interface{}) (json.RawMessage, error) {
+	rows, err := q.Query("SELECT * FROM "+table+" WHERE "+column+" = ?", value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]interface{}, len(columns))
+	for i, name := range columns {
+		name = strings.ToLower(name)
+		if redactedColumns[name] {
+			continue
+		}
+		switch value := values[i].(type) {
+		case []byte:
+			row[name] = string(value)
+		case time.Time:
+			row[name] = value.UTC().Format(time.RFC3339)
+		default:
+			row[name] = value
+		}
+	}
+	return json.Marshal(row)
+}
+
+// Redact returns a copy of a JSON document without the members holding secrets, at any depth,
+// or nil when it is not valid JSON.
+func Redact(document []byte) json.RawMessage {
+	var value interface{}
+	if err := json.Unmarshal(document, &value); err != nil {
+		return nil
+	}
+	redacted, err := json.Marshal(redact(value))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func redact(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, member := range value {
+			if redactedColumns[strings.ToLower(name)] {
+				delete(value, name)
+				continue
+			}
+			value[name] = redact(member)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redact(item)
+		}
+	}
+	return value
+}
@@ -5,12 +5,29 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/joho/godotenv"
 )
 
-func ConnectToDB() (db *sql.DB) {
+var (
+	pool     *sql.DB
+	poolOnce sync.Once
+)
+
+// ConnectToDB returns the application's database handle.
+// The first call opens and pings the connection pool; every later call shares it,
+// so handlers no longer open a new pool per request.
+func ConnectToDB() *sql.DB {
+	poolOnce.Do(func() {
+		pool = openDB()
+	})
+	return pool
+}
+
+// openDB opens a connection pool using the database settings from the .env file.
+func openDB() (db *sql.DB) {
 	// Load environment variables from the .env file
 	envErr := godotenv.Load()
 	if envErr != nil {
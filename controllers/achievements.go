@@ -0,0 +1,119 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for the achievements and badges students earn in the house-cup application.
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gambinish/house-cup/achievements"
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/events"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// grantAchievements evaluates the achievement rules for the students of awarded points records within tx.
+// It returns an event for every achievement granted, for the house of the record that earned it.
+func grantAchievements(tx *sql.Tx, awarded []models.Point) ([]events.Event, error) {
+	granted, err := achievements.Default.Evaluate(tx, awarded)
+	if err != nil {
+		return nil, err
+	}
+
+	houses := map[int64]int64{}
+	for _, point := range awarded {
+		houses[point.ID] = point.House_ID
+	}
+	changes := make([]events.Event, 0, len(granted))
+	for _, achievement := range granted {
+		changes = append(changes, events.Event{Type: events.AchievementGranted, House_ID: houses[*achievement.Point_ID], Data: achievement})
+	}
+	return changes, nil
+}
+
+// studentAchievements returns the achievements a student was granted, oldest first.
+func studentAchievements(db *sql.DB, studentID int64) ([]models.Achievement, error) {
+	rows, err := db.Query("SELECT "+achievements.Columns+" FROM Student_Achievements WHERE Student_ID = ? ORDER BY ID", studentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	granted := []models.Achievement{}
+	for rows.Next() {
+		achievement, err := achievements.Scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		granted = append(granted, achievement)
+	}
+	return granted, rows.Err()
+}
+
+// badge is an achievement rule with how many students earned it.
+type badge struct {
+	achievements.Rule
+	Students int64 `json:"students"`
+}
+
+// GetBadges lists the achievements students can earn, as defined in the achievements config file,
+// with how many students earned each of them, in JSON format.
+func GetBadges(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	rows, err := db.Query("SELECT Achievement_Key, COUNT(*) FROM Student_Achievements GROUP BY Achievement_Key")
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getBadges: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	earned := map[string]int64{}
+	for rows.Next() {
+		var key string
+		var count int64
+		if err := rows.Scan(&key, &count); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getBadges: %v", err)})
+			return
+		}
+		earned[key] = count
+	}
+	if err := rows.Err(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getBadges: %v", err)})
+		return
+	}
+
+	badges := []badge{}
+	for _, rule := range achievements.Default.Rules() {
+		badges = append(badges, badge{Rule: rule, Students: earned[rule.Key]})
+	}
+	c.IndentedJSON(http.StatusOK, badges)
+}
+
+// GetBadgesByStudentId retrieves the achievements a specific student was granted.
+// It takes the student ID as a URL parameter and returns the student's achievements, oldest first, in JSON format.
+func GetBadgesByStudentId(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	parsedID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getBadges: %v", err)})
+		return
+	}
+
+	if err := checkVersion(db, "Students", parsedID, nil); err != nil {
+		respondWriteError(c, "getBadges", err)
+		return
+	}
+
+	granted, err := studentAchievements(db, parsedID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getBadges: %v", err)})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, granted)
+}
@@ -0,0 +1,306 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for assigning students to houses in the house-cup application.
+package controllers
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Assignment strategies supported by AssignStudentsByTournamentId.
+const (
+	// AssignRoundRobin deals students to houses in turn, in order of student ID.
+	AssignRoundRobin = "round_robin"
+	// AssignBalanced places each student in the house with the fewest members.
+	AssignBalanced = "balanced"
+	// AssignRandom shuffles students with a seed before dealing them to houses in turn.
+	AssignRandom = "random"
+)
+
+// assignmentRequest is the payload of an assignment run.
+// Student_IDs defaults to every student without a house; each Keep_Together group lands in the same house.
+type assignmentRequest struct {
+	Strategy      string    `json:"strategy" binding:"required"`
+	Seed          *int64    `json:"seed"`
+	Student_IDs   []int64   `json:"student_ids"`
+	Keep_Together [][]int64 `json:"keep_together"`
+	Preview       bool      `json:"preview"`
+}
+
+// assignment places one student in one house.
+type assignment struct {
+	Student_ID   int64  `json:"student_id"`
+	Student_Name string `json:"student_name"`
+	House_ID     int64  `json:"house_id"`
+	House_Name   string `json:"house_name"`
+}
+
+// assignmentHouse is a candidate house and its current number of members.
+type assignmentHouse struct {
+	house   models.House
+	members int
+}
+
+// planAssignments distributes units of students (each unit must share a house) across houses.
+// houses must be ordered by ID and units by their first student ID; member counts are updated as units are placed.
+func planAssignments(strategy string, seed int64, houses []*assignmentHouse, units [][]models.Student) []assignment {
+	placed := func(unit []models.Student, house *assignmentHouse) []assignment {
+		house.members += len(unit)
+		result := make([]assignment, 0, len(unit))
+		for _, student := range unit {
+			result = append(result, assignment{Student_ID: student.ID, Student_Name: student.Student_Name, House_ID: house.house.ID, House_Name: house.house.House_Name})
+		}
+		return result
+	}
+
+	var plan []assignment
+	switch strategy {
+	case AssignBalanced:
+		// Larger units first so they do not tip the balance at the end
+		ordered := append([][]models.Student(nil), units...)
+		sort.SliceStable(ordered, func(i, j int) bool { return len(ordered[i]) > len(ordered[j]) })
+		for _, unit := range ordered {
+			smallest := houses[0]
+			for _, house := range houses[1:] {
+				if house.members < smallest.members {
+					smallest = house
+				}
+			}
+			plan = append(plan, placed(unit, smallest)...)
+		}
+	case AssignRandom:
+		rng := rand.New(rand.NewSource(seed))
+		shuffled := append([][]models.Student(nil), units...)
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		offset := rng.Intn(len(houses))
+		for i, unit := range shuffled {
+			plan = append(plan, placed(unit, houses[(offset+i)%len(houses)])...)
+		}
+	default:
+		for i, unit := range units {
+			plan = append(plan, placed(unit, houses[i%len(houses)])...)
+		}
+	}
+
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Student_ID < plan[j].Student_ID })
+	return plan
+}
+
+// AssignStudentsByTournamentId distributes students that are not enrolled in a tournament across its houses.
+// It takes the tournament ID as a URL parameter and parses the strategy (round_robin, balanced or random),
+// an optional seed, the students to assign and keep-together groups from the JSON payload.
+// Without student_ids every student that has no house yet is assigned. With preview set it only returns the plan;
+// otherwise it enrolls every student in their planned house in a single transaction.
+// It returns the plan, the seed used and the resulting house sizes in JSON format.
+func AssignStudentsByTournamentId(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("assignStudents: %v", err)})
+		return
+	}
+
+	var request assignmentRequest
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+	if request.Strategy != AssignRoundRobin && request.Strategy != AssignBalanced && request.Strategy != AssignRandom {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("assignStudents: strategy must be %q, %q or %q", AssignRoundRobin, AssignBalanced, AssignRandom)})
+		return
+	}
+
+	// Report the seed so a preview can be committed with exactly the same outcome
+	seed := time.Now().UnixNano()
+	if request.Seed != nil {
+		seed = *request.Seed
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("assignStudents: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	// Deleted students keep their enrollments but no longer count towards a house's size
+	rows, err := tx.Query(`SELECT Houses.ID, Houses.House_Name, COUNT(Students.ID)
+							FROM Houses
+							LEFT JOIN Enrollments ON Enrollments.House_ID = Houses.ID
+							LEFT JOIN Students ON Students.ID = Enrollments.Student_ID AND Students.Deleted_At IS NULL
+							WHERE Houses.Tournament_ID = ?
+							GROUP BY Houses.ID, Houses.House_Name
+							ORDER BY Houses.ID`, parsedID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("assignStudents: %v", err)})
+		return
+	}
+	var houses []*assignmentHouse
+	for rows.Next() {
+		house := &assignmentHouse{}
+		if err := rows.Scan(&house.house.ID, &house.house.House_Name, &house.members); err != nil {
+			rows.Close()
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("assignStudents: %v", err)})
+			return
+		}
+		houses = append(houses, house)
+	}
+	rows.Close()
+	if len(houses) == 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("assignStudents: tournament %d has no houses", parsedID)})
+		return
+	}
+
+	// A student's House_ID here is their house in this tournament, if they are already enrolled in it
+	query := `SELECT Students.ID, Students.Student_Name, Enrollments.House_ID
+				FROM Students
+				LEFT JOIN Enrollments ON Enrollments.Student_ID = Students.ID AND Enrollments.Tournament_ID = ?`
+	args := []interface{}{parsedID}
+	if request.Student_IDs == nil {
+		query += " WHERE Students.Deleted_At IS NULL AND Students.House_ID IS NULL AND Enrollments.ID IS NULL"
+	} else {
+		if len(request.Student_IDs) == 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "assignStudents: student_ids is empty"})
+			return
+		}
+		placeholders := make([]string, len(request.Student_IDs))
+		for i, studentID := range request.Student_IDs {
+			placeholders[i] = "?"
+			args = append(args, studentID)
+		}
+		query += " WHERE Students.Deleted_At IS NULL AND Students.ID IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+
+	rows, err = tx.Query(query+" ORDER BY Students.ID FOR UPDATE", args...)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("assignStudents: %v", err)})
+		return
+	}
+	students := map[int64]models.Student{}
+	var order []int64
+	for rows.Next() {
+		var student models.Student
+		if err := rows.Scan(&student.ID, &student.Student_Name, &student.House_ID); err != nil {
+			rows.Close()
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("assignStudents: %v", err)})
+			return
+		}
+		students[student.ID] = student
+		order = append(order, student.ID)
+	}
+	rows.Close()
+
+	var problems []string
+	for _, studentID := range request.Student_IDs {
+		student, ok := students[studentID]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("student %d not found", studentID))
+		} else if student.House_ID != nil {
+			problems = append(problems, fmt.Sprintf("student %d is already enrolled in this tournament through house %d", studentID, *student.House_ID))
+		}
+	}
+
+	// Build the units: keep-together groups first claim their students, everyone else stands alone
+	grouped := map[int64]bool{}
+	var units [][]models.Student
+	for i, group := range request.Keep_Together {
+		var unit []models.Student
+		for _, studentID := range group {
+			student, ok := students[studentID]
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("keep_together group %d: student %d is not being assigned", i, studentID))
+			case grouped[studentID]:
+				problems = append(problems, fmt.Sprintf("keep_together group %d: student %d is already in another group", i, studentID))
+			default:
+				grouped[studentID] = true
+				unit = append(unit, student)
+			}
+		}
+		if len(unit) > 0 {
+			units = append(units, unit)
+		}
+	}
+	if len(problems) > 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": "assignStudents: invalid request", "problems": problems})
+		return
+	}
+	for _, studentID := range order {
+		if !grouped[studentID] {
+			units = append(units, []models.Student{students[studentID]})
+		}
+	}
+	sort.SliceStable(units, func(i, j int) bool { return units[i][0].ID < units[j][0].ID })
+
+	plan := planAssignments(request.Strategy, seed, houses, units)
+	if plan == nil {
+		plan = []assignment{}
+	}
+
+	if !request.Preview {
+		for _, placement := range plan {
+			if err := enrollStudent(tx, placement.Student_ID, placement.House_ID); err != nil {
+				c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("assignStudents: %v", err)})
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("assignStudents: %v", err)})
+			return
+		}
+	}
+
+	sizes := map[string]int{}
+	for _, house := range houses {
+		sizes[strconv.FormatInt(house.house.ID, 10)] = house.members
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"strategy":    request.Strategy,
+		"seed":        seed,
+		"preview":     request.Preview,
+		"assignments": plan,
+		"house_sizes": sizes,
+	})
+}
+
+// GetUnassignedStudents retrieves the students that are not assigned to a house yet.
+// It queries the database for students without a house, leaving out deleted ones, and returns the results in JSON format.
+func GetUnassignedStudents(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	rows, err := db.Query("SELECT * FROM Students WHERE House_ID IS NULL AND Deleted_At IS NULL")
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getUnassignedStudents: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	students := []models.Student{}
+	// Loop through rows, using Scan to assign column data to struct fields.
+	for rows.Next() {
+		var student models.Student
+		if err := rows.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID, &student.Deleted_At, &student.Deletion_Policy); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getUnassignedStudents: %v", err)})
+			return
+		}
+		students = append(students, student)
+	}
+	if err := rows.Err(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getUnassignedStudents: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, students)
+}
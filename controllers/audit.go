@@ -0,0 +1,84 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for reading the audit log of the house-cup application.
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAuditLog retrieves audit log entries, newest first, for administrators.
+// It takes optional actor, entity, entity_id, method, request_id and status query parameters to filter on,
+// a from/to date range, and pages with limit (100 by default, at most 1000) and before_id, the ID of the
+// oldest entry already seen. The response holds the entries and next_before_id to fetch the next page.
+func GetAuditLog(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	var filter exportFilter
+	for _, field := range []struct{ name, column string }{
+		{"actor", "Actor"}, {"entity", "Entity"}, {"entity_id", "Entity_ID"}, {"method", "Method"}, {"request_id", "Request_ID"},
+	} {
+		if value := c.Query(field.name); value != "" {
+			filter.add(field.column+" = ?", value)
+		}
+	}
+	if !filter.addID(c, "getAuditLog", "status", "Status_Code = ?") ||
+		!filter.addID(c, "getAuditLog", "before_id", "ID < ?") ||
+		!filter.addTimeRange(c, "getAuditLog", "Occurred_At") {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "getAuditLog: limit must be between 1 and 1000"})
+		return
+	}
+
+	rows, err := db.Query(`SELECT ID, Occurred_At, Request_ID, Actor, Action, Method, Path, Entity, Entity_ID, Status_Code,
+								Before_JSON, After_JSON, Client_IP
+							FROM Audit_Log`+filter.where()+`
+							ORDER BY ID DESC LIMIT ?`, append(filter.args, limit)...)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getAuditLog: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var entry models.AuditEntry
+		var before, after *string
+		err := rows.Scan(&entry.ID, &entry.Occurred_At, &entry.Request_ID, &entry.Actor, &entry.Action, &entry.Method, &entry.Path,
+			&entry.Entity, &entry.Entity_ID, &entry.Status_Code, &before, &after, &entry.Client_IP)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getAuditLog: %v", err)})
+			return
+		}
+		if before != nil {
+			raw := json.RawMessage(*before)
+			entry.Before = &raw
+		}
+		if after != nil {
+			raw := json.RawMessage(*after)
+			entry.After = &raw
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getAuditLog: %v", err)})
+		return
+	}
+
+	var nextBeforeID *int64
+	if len(entries) == limit {
+		nextBeforeID = &entries[len(entries)-1].ID
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"entries": entries, "next_before_id": nextBeforeID})
+}
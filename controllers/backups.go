@@ -0,0 +1,388 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for backing up and restoring whole tournaments in the house-cup application.
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/ledger"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Identification of tournament archives. archiveVersion is bumped whenever the document changes incompatibly.
+const (
+	archiveFormat  = "house-cup/tournament"
+	archiveVersion = 1
+)
+
+// tournamentArchive is a portable copy of a tournament with everything that belongs to it.
+// IDs are those of the instance it was exported from and are only used to link the records together.
+type tournamentArchive struct {
+	Format      string              `json:"format" binding:"required"`
+	Version     int                 `json:"version" binding:"required"`
+	Exported_At string              `json:"exported_at"`
+	Tournament  models.Tournament   `json:"tournament"`
+	Houses      []models.House      `json:"houses"`
+	Students    []models.Student    `json:"students"`
+	Enrollments []models.Enrollment `json:"enrollments"`
+	Points      []models.Point      `json:"points"`
+	Transfers   []models.Transfer   `json:"transfers"`
+}
+
+// readArchive loads the archive of a tournament within tx.
+func readArchive(tx *sql.Tx, tournamentID int64) (*tournamentArchive, error) {
+	archive := &tournamentArchive{
+		Format:      archiveFormat,
+		Version:     archiveVersion,
+		Exported_At: time.Now().UTC().Format(time.RFC3339),
+		Houses:      []models.House{},
+		Students:    []models.Student{},
+		Enrollments: []models.Enrollment{},
+		Points:      []models.Point{},
+		Transfers:   []models.Transfer{},
+	}
+
+	err := tx.QueryRow("SELECT * FROM Tournaments WHERE ID = ?", tournamentID).Scan(&archive.Tournament.ID, &archive.Tournament.Tournament_Name, &archive.Tournament.Created_At, &archive.Tournament.Ended_At, &archive.Tournament.Version)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	queries := []struct {
+		query string
+		args  []interface{}
+		scan  func(*sql.Rows) error
+	}{
+		{"SELECT * FROM Houses WHERE Tournament_ID = ? ORDER BY ID", []interface{}{tournamentID}, func(rows *sql.Rows) error {
+			var house models.House
+			err := rows.Scan(&house.ID, &house.House_Name, &house.House_Points, &house.Tournament_ID, &house.Version)
+			archive.Houses = append(archive.Houses, house)
+			return err
+		}},
+		// Students come along when they are enrolled in the tournament or earned points in it
+		{`SELECT * FROM Students WHERE ID IN (
+				SELECT Student_ID FROM Enrollments WHERE Tournament_ID = ?
+				UNION SELECT Points.Student_ID FROM Points JOIN Houses ON Points.House_ID = Houses.ID WHERE Houses.Tournament_ID = ?)
+			ORDER BY ID`, []interface{}{tournamentID, tournamentID}, func(rows *sql.Rows) error {
+			var student models.Student
+			err := rows.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID, &student.Deleted_At, &student.Deletion_Policy)
+			archive.Students = append(archive.Students, student)
+			return err
+		}},
+		{"SELECT ID, Student_ID, Tournament_ID, House_ID, Enrolled_At FROM Enrollments WHERE Tournament_ID = ? ORDER BY ID", []interface{}{tournamentID}, func(rows *sql.Rows) error {
+			var enrollment models.Enrollment
+			err := rows.Scan(&enrollment.ID, &enrollment.Student_ID, &enrollment.Tournament_ID, &enrollment.House_ID, &enrollment.Enrolled_At)
+			archive.Enrollments = append(archive.Enrollments, enrollment)
+			return err
+		}},
+		{`SELECT Points.ID, Points.Points, COALESCE(Points.Notes, ''), Points.Student_ID, Points.House_ID, Points.Created_At, Points.Kind, Points.Reverses_ID,
+				Points.Raw_Points, Points.Category, Points.Multiplier_IDs
+			FROM Points JOIN Houses ON Points.House_ID = Houses.ID
+			WHERE Houses.Tournament_ID = ? ORDER BY Points.ID`, []interface{}{tournamentID}, func(rows *sql.Rows) error {
+			var point models.Point
+			err := rows.Scan(&point.ID, &point.Points, &point.Notes, &point.Student_ID, &point.House_ID, &point.Created_At, &point.Kind, &point.Reverses_ID, &point.Raw_Points, &point.Category, &point.Multiplier_IDs)
+			archive.Points = append(archive.Points, point)
+			return err
+		}},
+		// Transfers only ever happen between houses of the same tournament
+		{`SELECT Student_Transfers.* FROM Student_Transfers JOIN Houses ON Student_Transfers.To_House_ID = Houses.ID
+			WHERE Houses.Tournament_ID = ? ORDER BY Student_Transfers.ID`, []interface{}{tournamentID}, func(rows *sql.Rows) error {
+			var transfer models.Transfer
+			err := rows.Scan(&transfer.ID, &transfer.Student_ID, &transfer.From_House_ID, &transfer.To_House_ID, &transfer.Policy, &transfer.Points_Moved, &transfer.Notes, &transfer.Transferred_At)
+			archive.Transfers = append(archive.Transfers, transfer)
+			return err
+		}},
+	}
+	for _, q := range queries {
+		rows, err := tx.Query(q.query, q.args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			if err := q.scan(rows); err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return archive, nil
+}
+
+// validate checks that every record of the archive links to records that are part of it.
+func (a *tournamentArchive) validate() []string {
+	var problems []string
+	if a.Format != archiveFormat {
+		problems = append(problems, fmt.Sprintf("format must be %q", archiveFormat))
+	}
+	if a.Version != archiveVersion {
+		problems = append(problems, fmt.Sprintf("unsupported archive version %d, this server reads version %d", a.Version, archiveVersion))
+	}
+	if a.Tournament.Tournament_Name == "" || a.Tournament.Created_At == "" {
+		problems = append(problems, "tournament needs a tournament_name and created_at")
+	}
+
+	houses := map[int64]bool{}
+	for _, house := range a.Houses {
+		if houses[house.ID] {
+			problems = append(problems, fmt.Sprintf("house %d appears twice", house.ID))
+		}
+		houses[house.ID] = true
+	}
+	students := map[int64]bool{}
+	externalIDs := map[string]bool{}
+	for _, student := range a.Students {
+		if students[student.ID] {
+			problems = append(problems, fmt.Sprintf("student %d appears twice", student.ID))
+		}
+		students[student.ID] = true
+		if student.External_ID != nil {
+			if externalIDs[*student.External_ID] {
+				problems = append(problems, fmt.Sprintf("external ID %q appears twice", *student.External_ID))
+			}
+			externalIDs[*student.External_ID] = true
+		}
+	}
+
+	enrolled := map[int64]bool{}
+	for _, enrollment := range a.Enrollments {
+		switch {
+		case !students[enrollment.Student_ID]:
+			problems = append(problems, fmt.Sprintf("enrollment %d: unknown student %d", enrollment.ID, enrollment.Student_ID))
+		case !houses[enrollment.House_ID]:
+			problems = append(problems, fmt.Sprintf("enrollment %d: unknown house %d", enrollment.ID, enrollment.House_ID))
+		case enrolled[enrollment.Student_ID]:
+			problems = append(problems, fmt.Sprintf("enrollment %d: student %d is enrolled twice", enrollment.ID, enrollment.Student_ID))
+		}
+		enrolled[enrollment.Student_ID] = true
+	}
+	points := map[int64]bool{}
+	reversed := map[int64]bool{}
+	for _, point := range a.Points {
+		if point.Kind != "" && !ledger.KnownKind(point.Kind) {
+			problems = append(problems, fmt.Sprintf("point %d: unknown kind %q", point.ID, point.Kind))
+		}
+		// Records are restored in order, so a reversal has to follow the record it reverses
+		if point.Reverses_ID != nil {
+			switch {
+			case !points[*point.Reverses_ID]:
+				problems = append(problems, fmt.Sprintf("point %d: reverses unknown or later point %d", point.ID, *point.Reverses_ID))
+			case reversed[*point.Reverses_ID]:
+				problems = append(problems, fmt.Sprintf("point %d: point %d is reversed twice", point.ID, *point.Reverses_ID))
+			}
+			reversed[*point.Reverses_ID] = true
+		}
+		points[point.ID] = true
+		if !houses[point.House_ID] {
+			problems = append(problems, fmt.Sprintf("point %d: unknown house %d", point.ID, point.House_ID))
+		}
+		if point.Student_ID != nil && !students[*point.Student_ID] {
+			problems = append(problems, fmt.Sprintf("point %d: unknown student %d", point.ID, *point.Student_ID))
+		}
+	}
+	for _, transfer := range a.Transfers {
+		if !students[transfer.Student_ID] || !houses[transfer.From_House_ID] || !houses[transfer.To_House_ID] {
+			problems = append(problems, fmt.Sprintf("transfer %d: unknown student or house", transfer.ID))
+		}
+	}
+	return problems
+}
+
+// BackupTournamentById exports a tournament as a versioned JSON archive.
+// It takes the tournament ID as a URL parameter and, from a single consistent snapshot, returns the tournament,
+// its houses, the students enrolled in it or holding points in it, their enrollments, the points ledger and the
+// transfer history as a JSON attachment that RestoreTournament can import into any instance.
+func BackupTournamentById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("backupTournament: %v", err)})
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("backupTournament: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	archive, err := readArchive(tx, parsedID)
+	if err != nil {
+		respondWriteError(c, "backupTournament", err)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"tournament-%d.json\"", parsedID))
+	c.IndentedJSON(http.StatusOK, archive)
+}
+
+// RestoreTournament imports a tournament archive produced by BackupTournamentById as a new tournament.
+// It parses the archive from the JSON payload, checks its format version and that all of its records link up,
+// and then, in a single transaction, creates the tournament, houses, enrollments, points and transfers with new IDs.
+// Students with an external ID that already exists here are reused rather than duplicated and receive the restored
+// points on top of their own; other students are created. House totals are recomputed from the restored ledger.
+// It returns the new tournament and the mapping from archived to new IDs in JSON format.
+func RestoreTournament(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	var archive tournamentArchive
+	if err := c.BindJSON(&archive); err != nil {
+		return
+	}
+	if problems := archive.validate(); len(problems) > 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": "restoreTournament: invalid archive", "problems": problems})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("restoreTournament: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	fail := func(err error) {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("restoreTournament: %v", err)})
+	}
+
+	tournament := archive.Tournament
+	result, err := tx.Exec("INSERT INTO Tournaments (tournament_name, created_at, ended_at) VALUES (?, ?, ?)", tournament.Tournament_Name, tournament.Created_At, tournament.Ended_At)
+	if err == nil {
+		tournament.ID, err = result.LastInsertId()
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	houseIDs := map[int64]int64{}
+	for _, house := range archive.Houses {
+		result, err := tx.Exec("INSERT INTO Houses (house_name, house_points, tournament_id) VALUES (?, 0, ?)", house.House_Name, tournament.ID)
+		if err == nil {
+			houseIDs[house.ID], err = result.LastInsertId()
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	enrolledHouse := map[int64]int64{}
+	for _, enrollment := range archive.Enrollments {
+		enrolledHouse[enrollment.Student_ID] = houseIDs[enrollment.House_ID]
+	}
+
+	studentIDs := map[int64]int64{}
+	reused := 0
+	for _, student := range archive.Students {
+		var houseID *int64
+		if newHouseID, ok := enrolledHouse[student.ID]; ok {
+			houseID = &newHouseID
+		}
+
+		var existingID int64
+		err := sql.ErrNoRows
+		if student.External_ID != nil {
+			err = tx.QueryRow("SELECT ID FROM Students WHERE External_ID = ? FOR UPDATE", *student.External_ID).Scan(&existingID)
+		}
+		switch {
+		case err == nil:
+			// The student's current house only changes when they have none
+			_, err = tx.Exec("UPDATE Students SET House_ID = COALESCE(House_ID, ?), Version = Version + 1 WHERE ID = ?", houseID, existingID)
+			if err == nil {
+				err = ledger.RefreshStudentTotals(tx, existingID)
+			}
+			studentIDs[student.ID] = existingID
+			reused++
+		case err == sql.ErrNoRows:
+			var result sql.Result
+			// Students deleted when the archive was taken stay deleted
+			result, err = tx.Exec("INSERT INTO Students (student_name, points, house_id, external_id, deleted_at, deletion_policy) VALUES (?, 0, ?, ?, ?, ?)",
+				student.Student_Name, houseID, student.External_ID, student.Deleted_At, student.Deletion_Policy)
+			if err == nil {
+				studentIDs[student.ID], err = result.LastInsertId()
+			}
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	for _, enrollment := range archive.Enrollments {
+		_, err := tx.Exec("INSERT INTO Enrollments (Student_ID, Tournament_ID, House_ID, Enrolled_At) VALUES (?, ?, ?, COALESCE(NULLIF(?, ''), CURRENT_TIMESTAMP))",
+			studentIDs[enrollment.Student_ID], tournament.ID, houseIDs[enrollment.House_ID], enrollment.Enrolled_At)
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	// Replaying the archived ledger brings the house and student totals up to date
+	pointIDs := map[int64]int64{}
+	for _, point := range archive.Points {
+		archivedID := point.ID
+		if point.Student_ID != nil {
+			newStudentID := studentIDs[*point.Student_ID]
+			point.Student_ID = &newStudentID
+		}
+		if point.Reverses_ID != nil {
+			newReversesID := pointIDs[*point.Reverses_ID]
+			point.Reverses_ID = &newReversesID
+		}
+		point.House_ID = houseIDs[point.House_ID]
+		// Multiplier rules are not archived; the raw and effective amounts still tell what they did
+		point.Multiplier_IDs = nil
+		appended, err := ledger.Append(tx, point)
+		if err != nil {
+			fail(err)
+			return
+		}
+		pointIDs[archivedID] = appended[0].ID
+	}
+
+	for _, transfer := range archive.Transfers {
+		_, err := tx.Exec(`INSERT INTO Student_Transfers (Student_ID, From_House_ID, To_House_ID, Policy, Points_Moved, Notes, Transferred_At)
+							VALUES (?, ?, ?, ?, ?, ?, COALESCE(NULLIF(?, ''), CURRENT_TIMESTAMP))`,
+			studentIDs[transfer.Student_ID], houseIDs[transfer.From_House_ID], houseIDs[transfer.To_House_ID], transfer.Policy, transfer.Points_Moved, transfer.Notes, transfer.Transferred_At)
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	err = tx.QueryRow("SELECT * FROM Tournaments WHERE ID = ?", tournament.ID).Scan(&tournament.ID, &tournament.Tournament_Name, &tournament.Created_At, &tournament.Ended_At, &tournament.Version)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		fail(err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{
+		"tournament":       tournament,
+		"houses":           houseIDs,
+		"students":         studentIDs,
+		"students_reused":  reused,
+		"points_restored":  len(archive.Points),
+		"transfers_copied": len(archive.Transfers),
+	})
+}
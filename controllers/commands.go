@@ -0,0 +1,393 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for the chat slash command interface of the house-cup application.
+package controllers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gambinish/house-cup/audit"
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Slash command replies are either shown to the whole channel or only to the person who typed the command.
+const (
+	replyInChannel = "in_channel"
+	replyEphemeral = "ephemeral"
+)
+
+// Limits of the target name matching.
+const (
+	// commandMaxNameWords is the longest name, in words, tried as a target.
+	commandMaxNameWords = 6
+	// commandMinSimilarity is the lowest similarity accepted for a misspelt name.
+	commandMinSimilarity = 0.75
+	// slackMaxSkew is how old a signed Slack request may be before it is refused as a replay.
+	slackMaxSkew = 5 * time.Minute
+)
+
+// commandUsage is the reply to an empty or malformed command.
+const commandUsage = "Usage: `+10 Harry Potter for helping a classmate` or `-5 Slytherin late to assembly`. " +
+	"Name a student or a house after the amount, then an optional note."
+
+// commandAmount matches the signed amount that starts a command.
+var commandAmount = regexp.MustCompile(`^([+-]\d+)\s+(.+)$`)
+
+// commandConnectives are leading words dropped from a note, so "for helping" is recorded as "helping".
+var commandConnectives = map[string]bool{"for": true, "because": true, "-": true, ":": true, "–": true, "—": true}
+
+// commandTarget is a student or house that an award can name.
+type commandTarget struct {
+	student    bool
+	id         int64
+	name       string
+	houseID    int64
+	houseName  string
+	tournament string
+}
+
+// describe names the target in a reply, adding the house or tournament that tells it apart.
+func (t commandTarget) describe() string {
+	if t.student {
+		return fmt.Sprintf("%s (%s)", t.name, t.houseName)
+	}
+	if t.tournament != "" {
+		return fmt.Sprintf("%s (%s)", t.name, t.tournament)
+	}
+	return t.name
+}
+
+// commandMatch is a target and how well a span of the command's words matched its name.
+type commandMatch struct {
+	target commandTarget
+	words  int
+	score  float64
+}
+
+// verifyCommand checks that a command comes from the chat workspace. A Slack request must carry a valid
+// signature made with SLACK_SIGNING_SECRET; otherwise the form's token must equal SLASH_COMMAND_TOKEN,
+// as Mattermost and legacy Slack commands send it. When neither is configured every request is refused.
+func verifyCommand(c *gin.Context, body []byte) bool {
+	secret := os.Getenv("SLACK_SIGNING_SECRET")
+	token := os.Getenv("SLASH_COMMAND_TOKEN")
+
+	if signature := c.GetHeader("X-Slack-Signature"); secret != "" && signature != "" {
+		timestamp := c.GetHeader("X-Slack-Request-Timestamp")
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(unix, 0)).Abs() > slackMaxSkew {
+			return false
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("v0:" + timestamp + ":"))
+		mac.Write(body)
+		return hmac.Equal([]byte("v0="+hex.EncodeToString(mac.Sum(nil))), []byte(signature))
+	}
+	if token != "" {
+		return subtle.ConstantTimeCompare([]byte(c.PostForm("token")), []byte(token)) == 1
+	}
+	return false
+}
+
+// CommandsEnabled reports whether chat commands can be verified, which they must be to be accepted.
+func CommandsEnabled() bool {
+	return os.Getenv("SLACK_SIGNING_SECRET") != "" || os.Getenv("SLASH_COMMAND_TOKEN") != ""
+}
+
+// loadCommandTargets reads the students with a house and the houses that a command may name.
+// With a tournament only its houses and enrolled students are candidates; otherwise those of every running tournament.
+func loadCommandTargets(db *sql.DB, tournamentID int64) ([]commandTarget, error) {
+	scope := "(Tournaments.Ended_At IS NULL OR Tournaments.Ended_At > NOW())"
+	args := []interface{}{}
+	if tournamentID > 0 {
+		scope = "Tournaments.ID = ?"
+		args = append(args, tournamentID)
+	}
+
+	rows, err := db.Query(`SELECT Houses.ID, Houses.House_Name, Tournaments.Tournament_Name
+							FROM Houses
+							JOIN Tournaments ON Tournaments.ID = Houses.Tournament_ID
+							WHERE `+scope+` ORDER BY Houses.ID`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var targets []commandTarget
+	for rows.Next() {
+		var target commandTarget
+		if err := rows.Scan(&target.id, &target.name, &target.tournament); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		target.houseID, target.houseName = target.id, target.name
+		targets = append(targets, target)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Only name the tournament of a house when houses of several tournaments are candidates
+	tournaments := map[string]bool{}
+	for _, target := range targets {
+		tournaments[target.tournament] = true
+	}
+	if len(tournaments) < 2 {
+		for i := range targets {
+			targets[i].tournament = ""
+		}
+	}
+
+	rows, err = db.Query(`SELECT Students.ID, Students.Student_Name, Houses.ID, Houses.House_Name
+							FROM Students
+							JOIN Houses ON Houses.ID = Students.House_ID
+							JOIN Tournaments ON Tournaments.ID = Houses.Tournament_ID
+							WHERE Students.Deleted_At IS NULL AND `+scope+` ORDER BY Students.ID`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		target := commandTarget{student: true}
+		if err := rows.Scan(&target.id, &target.name, &target.houseID, &target.houseName); err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, rows.Err()
+}
+
+// normalizeName lowercases a name, collapses its whitespace and drops trailing punctuation
+// such as the colon in "Hermione: great essay" for comparison.
+func normalizeName(name string) string {
+	return strings.TrimRight(strings.ToLower(strings.Join(strings.Fields(name), " ")), ":,;.!")
+}
+
+// nameSimilarity scores how well typed matches name: 1 for the same name, 0.9 when typed is the
+// start of the name in whole words ("Harry" for "Harry Potter"), otherwise the share of characters
+// that need no edit, capped below the prefix score.
+func nameSimilarity(typed string, name string) float64 {
+	typed, name = normalizeName(typed), normalizeName(name)
+	switch {
+	case typed == name:
+		return 1
+	case strings.HasPrefix(name, typed+" "):
+		return 0.9
+	}
+
+	a, b := []rune(typed), []rune(name)
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 0
+	}
+	similarity := 1 - float64(levenshtein(a, b))/float64(longest)
+	if similarity > 0.85 {
+		similarity = 0.85
+	}
+	return similarity
+}
+
+// levenshtein returns the number of single character edits that turn a into b.
+func levenshtein(a []rune, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// matchCommandTarget finds the target named by the first words of a command. Every span of leading words
+// is compared with every candidate; the best score wins and longer spans break ties. It returns the best
+// matches, more than one when the name is ambiguous, and none when nothing is similar enough.
+func matchCommandTarget(words []string, targets []commandTarget) []commandMatch {
+	var best []commandMatch
+	for span := 1; span <= len(words) && span <= commandMaxNameWords; span++ {
+		typed := strings.Join(words[:span], " ")
+		for _, target := range targets {
+			score := nameSimilarity(typed, target.name)
+			if score < commandMinSimilarity {
+				continue
+			}
+			match := commandMatch{target: target, words: span, score: score}
+			switch {
+			case len(best) == 0 || score > best[0].score || (score == best[0].score && span > best[0].words):
+				best = []commandMatch{match}
+			case score == best[0].score && span == best[0].words:
+				best = append(best, match)
+			}
+		}
+	}
+	return best
+}
+
+// commandNote builds the note of an award from the words after its target, dropping a leading connective.
+func commandNote(words []string) string {
+	for len(words) > 0 && commandConnectives[strings.ToLower(words[0])] {
+		words = words[1:]
+	}
+	note := strings.Join(words, " ")
+	// Notes are stored in a VARCHAR(255) column
+	for utf8.RuneCountInString(note) > 255 {
+		note = string([]rune(note)[:255])
+	}
+	return note
+}
+
+// commandReply answers a slash command. Slack and Mattermost only show replies sent with status 200.
+func commandReply(c *gin.Context, responseType string, text string) {
+	c.IndentedJSON(http.StatusOK, gin.H{"response_type": responseType, "text": text})
+}
+
+// AwardCommand awards points from a chat slash command such as "+10 Harry Potter for helping a classmate"
+// or "-5 Slytherin late to assembly". It accepts the form posts of Slack and Mattermost slash commands,
+// verified with SLACK_SIGNING_SECRET or SLASH_COMMAND_TOKEN, one of which must be set, and reads the signed amount,
+// the student or house (matched on the closest name, tolerating small misspellings) and an optional note
+// from the text field. An optional tournament_id query parameter restricts names to one tournament,
+// otherwise every running tournament is searched. The award takes the same path as PostPoints and the
+// reply shown in the channel holds the points credited after multipliers, along with the amount asked for
+// when they differ, and the new totals; mistakes are answered privately to the sender.
+func AwardCommand(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("awardCommand: %v", err)})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	if !verifyCommand(c, body) {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "awardCommand: request could not be verified"})
+		return
+	}
+
+	var tournamentID int64
+	if value := c.Query("tournament_id"); value != "" {
+		tournamentID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("awardCommand: invalid tournament_id %q", value)})
+			return
+		}
+	}
+
+	if user := c.PostForm("user_name"); user != "" {
+		c.Set(audit.ActorKey, "chat:"+user)
+	}
+
+	text := strings.TrimSpace(c.PostForm("text"))
+	parts := commandAmount.FindStringSubmatch(text)
+	if parts == nil {
+		commandReply(c, replyEphemeral, commandUsage)
+		return
+	}
+	amount, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || amount == 0 {
+		commandReply(c, replyEphemeral, "The amount must be a non-zero whole number. "+commandUsage)
+		return
+	}
+	words := strings.Fields(parts[2])
+
+	targets, err := loadCommandTargets(db, tournamentID)
+	if err != nil {
+		log.Print("awardCommand: ", err)
+		commandReply(c, replyEphemeral, "Sorry, the points could not be awarded. Please try again.")
+		return
+	}
+
+	matches := matchCommandTarget(words, targets)
+	switch {
+	case len(matches) == 0:
+		commandReply(c, replyEphemeral, fmt.Sprintf("No student or house is called %q.", parts[2]))
+		return
+	case len(matches) > 1:
+		var names []string
+		for _, match := range matches {
+			if len(names) == 5 {
+				names = append(names, "…")
+				break
+			}
+			names = append(names, match.target.describe())
+		}
+		commandReply(c, replyEphemeral, fmt.Sprintf("%q could be %s. Please use the full name.", strings.Join(words[:matches[0].words], " "), strings.Join(names, ", ")))
+		return
+	}
+	target := matches[0].target
+
+	point := models.Point{Points: amount, Notes: commandNote(words[matches[0].words:]), House_ID: target.houseID}
+	if target.student {
+		studentID := target.id
+		point.Student_ID = &studentID
+	}
+	awarded, err := recordAward(db, point)
+	if err != nil {
+		log.Print("awardCommand: ", err)
+		commandReply(c, replyEphemeral, fmt.Sprintf("Sorry, the points could not be awarded: %v", err))
+		return
+	}
+
+	var houseTotal int64
+	err = db.QueryRow("SELECT House_Points FROM Houses WHERE ID = ?", target.houseID).Scan(&houseTotal)
+	var studentTotal int64
+	if err == nil && target.student {
+		err = db.QueryRow("SELECT Points FROM Students WHERE ID = ?", target.id).Scan(&studentTotal)
+	}
+	if err != nil {
+		log.Print("awardCommand: ", err)
+	}
+
+	// Multipliers in effect change the amount credited
+	reply := fmt.Sprintf("%+d to %s", awarded.Points, target.describe())
+	if awarded.Points != awarded.Raw_Points {
+		reply += fmt.Sprintf(" (%+d multiplied)", awarded.Raw_Points)
+	}
+	if point.Notes != "" {
+		reply += ": " + point.Notes
+	}
+	if user := c.PostForm("user_name"); user != "" {
+		reply += " (from @" + user + ")"
+	}
+	if err == nil {
+		if target.student {
+			reply += fmt.Sprintf(". %s now has %d points and %s has %d.", target.name, studentTotal, target.houseName, houseTotal)
+		} else {
+			reply += fmt.Sprintf(". %s now has %d points.", target.houseName, houseTotal)
+		}
+	}
+	commandReply(c, replyInChannel, reply)
+}
@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCommandAmount(t *testing.T) {
+	tests := []struct {
+		text   string
+		amount string
+		rest   string
+	}{
+		{"+10 Harry Potter for helping a classmate", "+10", "Harry Potter for helping a classmate"},
+		{"-5 Slytherin late to assembly", "-5", "Slytherin late to assembly"},
+		{"+3   Luna", "+3", "Luna"},
+		{"10 Harry Potter", "", ""},
+		{"+ten Harry Potter", "", ""},
+		{"+10", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		parts := commandAmount.FindStringSubmatch(test.text)
+		if test.amount == "" {
+			if parts != nil {
+				t.Errorf("%q: matched %q, want no match", test.text, parts)
+			}
+			continue
+		}
+		if parts == nil || parts[1] != test.amount || parts[2] != test.rest {
+			t.Errorf("%q: got %q, want amount %q and %q", test.text, parts, test.amount, test.rest)
+		}
+	}
+}
+
+// commandTestTargets are the houses and students the matcher tests choose from.
+var commandTestTargets = []commandTarget{
+	{id: 1, name: "Gryffindor", houseID: 1, houseName: "Gryffindor"},
+	{id: 2, name: "Slytherin", houseID: 2, houseName: "Slytherin"},
+	{student: true, id: 10, name: "Harry Potter", houseID: 1, houseName: "Gryffindor"},
+	{student: true, id: 11, name: "Hermione Granger", houseID: 1, houseName: "Gryffindor"},
+	{student: true, id: 12, name: "Draco Malfoy", houseID: 2, houseName: "Slytherin"},
+	{student: true, id: 13, name: "Harry Smith", houseID: 2, houseName: "Slytherin"},
+}
+
+func TestMatchCommandTarget(t *testing.T) {
+	tests := []struct {
+		text  string
+		ids   []int64
+		words int
+		note  string
+	}{
+		{"Harry Potter for helping a classmate", []int64{10}, 2, "helping a classmate"},
+		{"Slytherin late to assembly", []int64{2}, 1, "late to assembly"},
+		{"harry potter: great essay", []int64{10}, 2, "great essay"},
+		{"Hermoine Granger because of her essay", []int64{11}, 2, "of her essay"},
+		{"Slytherine", []int64{2}, 1, ""},
+		// "Harry" starts the names of two students
+		{"Harry for trying", []int64{10, 13}, 1, ""},
+		{"Neville Longbottom", nil, 0, ""},
+	}
+	for _, test := range tests {
+		words := strings.Fields(test.text)
+		matches := matchCommandTarget(words, commandTestTargets)
+		var ids []int64
+		for _, match := range matches {
+			ids = append(ids, match.target.id)
+		}
+		if len(ids) != len(test.ids) {
+			t.Errorf("%q: matched %v, want %v", test.text, ids, test.ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.ids[i] {
+				t.Errorf("%q: matched %v, want %v", test.text, ids, test.ids)
+				break
+			}
+		}
+		if len(test.ids) != 1 {
+			continue
+		}
+		if matches[0].words != test.words {
+			t.Errorf("%q: name spans %d words, want %d", test.text, matches[0].words, test.words)
+		}
+		if note := commandNote(words[matches[0].words:]); note != test.note {
+			t.Errorf("%q: note %q, want %q", test.text, note, test.note)
+		}
+	}
+}
+
+func TestNameSimilarity(t *testing.T) {
+	tests := []struct {
+		typed string
+		name  string
+		min   float64
+		max   float64
+	}{
+		{"Harry Potter", "Harry Potter", 1, 1},
+		{"  harry   POTTER ", "Harry Potter", 1, 1},
+		{"Harry", "Harry Potter", 0.9, 0.9},
+		{"Harr", "Harry Potter", 0, commandMinSimilarity},
+		{"Hermoine Granger", "Hermione Granger", commandMinSimilarity, 0.85},
+		{"Draco", "Harry Potter", 0, commandMinSimilarity},
+	}
+	for _, test := range tests {
+		got := nameSimilarity(test.typed, test.name)
+		if got < test.min || got > test.max {
+			t.Errorf("nameSimilarity(%q, %q) = %v, want between %v and %v", test.typed, test.name, got, test.min, test.max)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+		{"hermoine", "hermione", 2},
+		{"élan", "elan", 1},
+	}
+	for _, test := range tests {
+		if got := levenshtein([]rune(test.a), []rune(test.b)); got != test.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestCommandNoteIsTruncated(t *testing.T) {
+	note := commandNote([]string{"for", strings.Repeat("é", 300)})
+	if got := len([]rune(note)); got != 255 {
+		t.Errorf("note has %d characters, want 255", got)
+	}
+}
+
+// commandContext returns a gin context for a slash command posting form.
+func commandContext(form url.Values) (*gin.Context, []byte) {
+	body := []byte(form.Encode())
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/commands/award", strings.NewReader(string(body)))
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c, body
+}
+
+func TestVerifyCommand(t *testing.T) {
+	form := url.Values{"token": {"s3cret"}, "text": {"+10 Harry Potter"}}
+
+	t.Setenv("SLACK_SIGNING_SECRET", "")
+	t.Setenv("SLASH_COMMAND_TOKEN", "")
+	c, body := commandContext(form)
+	if verifyCommand(c, body) {
+		t.Error("a command was accepted with no secret or token configured")
+	}
+	if CommandsEnabled() {
+		t.Error("commands are enabled with no secret or token configured")
+	}
+
+	t.Setenv("SLASH_COMMAND_TOKEN", "s3cret")
+	c, body = commandContext(form)
+	if !verifyCommand(c, body) {
+		t.Error("a command with the configured token was refused")
+	}
+	c, body = commandContext(url.Values{"token": {"wrong"}})
+	if verifyCommand(c, body) {
+		t.Error("a command with another token was accepted")
+	}
+}
@@ -0,0 +1,138 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for the house-cup application. This file holds the optimistic concurrency helpers
+// shared by the handlers of versioned resources.
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlDuplicateEntry is the MySQL error number for a unique key violation.
+const mysqlDuplicateEntry = 1062
+
+// MySQL error numbers for rows that reference a missing row or fail a CHECK constraint.
+const (
+	mysqlNoReferencedRow = 1452
+	mysqlCheckConstraint = 3819
+)
+
+var (
+	// errNotFound reports that the addressed row does not exist.
+	errNotFound = errors.New("not found")
+	// errPreconditionFailed reports that the row's version does not match the If-Match header.
+	errPreconditionFailed = errors.New("resource was modified, If-Match does not match its current version")
+	// errNoHouse reports a student that has to be in a house for the operation.
+	errNoHouse = errors.New("student is not assigned to a house")
+	// errDeleted reports a write to a soft deleted row that has to be restored first.
+	errDeleted = errors.New("resource is deleted, restore it first")
+	// errNotDeleted reports a restore of a row that is not deleted.
+	errNotDeleted = errors.New("resource is not deleted")
+	// errHasLedger reports the removal of a house whose points records the ledger keeps.
+	errHasLedger = errors.New("house has points records, which the ledger keeps; it cannot be deleted")
+)
+
+// softDeletable lists the tables whose rows are soft deleted by setting Deleted_At.
+// Such rows are kept for their history but count as missing for every write.
+var softDeletable = map[string]bool{"Students": true}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// execQuerier is satisfied by both *sql.DB and *sql.Tx.
+type execQuerier interface {
+	querier
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// etag formats a row version as a strong entity tag.
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// ifMatchVersion parses the If-Match request header into the version it names.
+// It returns nil when the header is absent or "*", in which case writes are unconditional.
+func ifMatchVersion(c *gin.Context) (*int64, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+
+	tag := strings.TrimPrefix(header, "W/")
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil {
+		return nil, fmt.Errorf("malformed If-Match header %q", header)
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed If-Match header %q", header)
+	}
+	return &version, nil
+}
+
+// checkVersion verifies that the row of table identified by id exists and, when ifMatch is set,
+// that its version still matches. Soft deleted rows do not exist here.
+// Pass a transaction and the row is locked until it ends.
+func checkVersion(q querier, table string, id int64, ifMatch *int64) error {
+	query := "SELECT Version FROM " + table + " WHERE ID = ?"
+	if softDeletable[table] {
+		query += " AND Deleted_At IS NULL"
+	}
+	if _, ok := q.(*sql.Tx); ok {
+		query += " FOR UPDATE"
+	}
+
+	var version int64
+	err := q.QueryRow(query, id).Scan(&version)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if ifMatch != nil && *ifMatch != version {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// isDuplicateEntry reports whether err is a unique key violation, such as a reused external ID.
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
+
+// isInvalidReference reports whether err is a foreign key or CHECK constraint violation,
+// such as a multiplier scoped to a missing house or ending before it starts.
+func isInvalidReference(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == mysqlNoReferencedRow || mysqlErr.Number == mysqlCheckConstraint)
+}
+
+// respondWriteError maps an error returned by a versioned write to its HTTP response.
+func respondWriteError(c *gin.Context, op string, err error) {
+	var invalid *patchError
+	switch {
+	case errors.Is(err, errNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s: %v", op, err)})
+	case errors.Is(err, errPreconditionFailed):
+		c.IndentedJSON(http.StatusPreconditionFailed, gin.H{"error": fmt.Sprintf("%s: %v", op, err)})
+	case errors.Is(err, errUseTransfer), errors.Is(err, errUseLedger), errors.Is(err, errDeleted), errors.Is(err, errNotDeleted), errors.Is(err, errHasLedger), errors.Is(err, errHouseTournament), errors.Is(err, errMultiplierApplied), isDuplicateEntry(err):
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%s: %v", op, err)})
+	case errors.Is(err, errNoHouse):
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("%s: %v", op, err)})
+	case errors.As(err, &invalid), isInvalidReference(err):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %v", op, err)})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s: %v", op, err)})
+	}
+}
@@ -0,0 +1,267 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for managing the tournaments students are enrolled in for the house-cup application.
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/ledger"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// enrollStudent enrolls a student in the tournament of houseID within tx and makes that house
+// the student's current house. An existing enrollment in the same tournament is moved to houseID,
+// so callers are responsible for keeping house totals right when that happens.
+func enrollStudent(tx *sql.Tx, studentID int64, houseID int64) error {
+	var tournamentID int64
+	err := tx.QueryRow("SELECT Tournament_ID FROM Houses WHERE ID = ?", houseID).Scan(&tournamentID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("house %d: %w", houseID, errNotFound)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO Enrollments (Student_ID, Tournament_ID, House_ID) VALUES (?, ?, ?)
+						ON DUPLICATE KEY UPDATE House_ID = VALUES(House_ID)`, studentID, tournamentID, houseID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE Students SET House_ID = ?, Version = Version + 1 WHERE ID = ? AND (House_ID IS NULL OR House_ID <> ?)", houseID, studentID, houseID)
+	if err != nil {
+		return err
+	}
+	// The student's points total follows them into the tournament of their new house
+	return ledger.RefreshStudentTotals(tx, studentID)
+}
+
+// enrollInHouse enrolls a student in houseID within tx unless they are already enrolled in its tournament.
+// It reports whether an enrollment was made and returns errUseTransfer when the student is in another house
+// of that tournament, since moving them has to go through TransferStudentById.
+func enrollInHouse(tx *sql.Tx, studentID int64, houseID int64) (bool, error) {
+	var current int64
+	err := tx.QueryRow(`SELECT Enrollments.House_ID FROM Enrollments
+						JOIN Houses ON Houses.Tournament_ID = Enrollments.Tournament_ID
+						WHERE Enrollments.Student_ID = ? AND Houses.ID = ?`, studentID, houseID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return true, enrollStudent(tx, studentID, houseID)
+	}
+	if err != nil {
+		return false, err
+	}
+	if current != houseID {
+		return false, errUseTransfer
+	}
+	return false, nil
+}
+
+// ensureEnrolled records the enrollment implied by a student's current house when it is missing.
+func ensureEnrolled(db *sql.DB, studentID int64, houseID int64) error {
+	_, err := db.Exec(`INSERT IGNORE INTO Enrollments (Student_ID, Tournament_ID, House_ID)
+						SELECT ?, Tournament_ID, ID FROM Houses WHERE ID = ?`, studentID, houseID)
+	return err
+}
+
+// removeHouses deletes the houses matching where within tx along with their transfers and enrollments.
+// The ledger keeps its records, so houses with points records are not deleted and errHasLedger is returned.
+// Students are kept: those whose current house is removed fall back to the house of their latest remaining
+// enrollment, or to no house at all, and are then totalled for the tournament of that house.
+func removeHouses(tx *sql.Tx, where string, args ...interface{}) error {
+	houses := "SELECT ID FROM Houses WHERE " + where
+
+	// Share-lock the records found so they cannot be appended to meanwhile; the foreign key refuses the rest
+	var records int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM Points WHERE House_ID IN ("+houses+") FOR SHARE", args...).Scan(&records); err != nil {
+		return err
+	}
+	if records > 0 {
+		return errHasLedger
+	}
+
+	// Students whose current house is removed fall back to another house, possibly of another tournament
+	rows, err := tx.Query("SELECT ID FROM Students WHERE House_ID IN ("+houses+")", args...)
+	if err != nil {
+		return err
+	}
+	var movedIDs []int64
+	for rows.Next() {
+		var studentID int64
+		if err := rows.Scan(&studentID); err != nil {
+			rows.Close()
+			return err
+		}
+		movedIDs = append(movedIDs, studentID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM Student_Transfers WHERE From_House_ID IN ("+houses+") OR To_House_ID IN ("+houses+")", append(append([]interface{}{}, args...), args...)...)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		"DELETE FROM Enrollments WHERE House_ID IN (" + houses + ")",
+		`UPDATE Students
+			SET House_ID = (SELECT House_ID FROM Enrollments WHERE Enrollments.Student_ID = Students.ID
+							ORDER BY Enrolled_At DESC, ID DESC LIMIT 1),
+				Version = Version + 1
+			WHERE House_ID IN (` + houses + `)`,
+		"DELETE FROM Houses WHERE " + where,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, args...); err != nil {
+			return err
+		}
+	}
+	return ledger.RefreshStudentTotals(tx, movedIDs...)
+}
+
+// insertStudent creates a student with no points within tx and, when they have a house,
+// enrolls them in its tournament. It returns the ID of the new student.
+func insertStudent(tx *sql.Tx, student models.Student) (int64, error) {
+	result, err := tx.Exec("INSERT INTO Students (student_name, points, house_id, external_id) VALUES (?, 0, ?, ?)", student.Student_Name, student.House_ID, student.External_ID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if student.House_ID != nil {
+		if err := enrollStudent(tx, id, *student.House_ID); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// GetEnrollmentsByStudentId retrieves the tournament history of a specific student.
+// It takes the student ID as a URL parameter, queries the database for every tournament the student
+// is enrolled in along with the points they earned in it, and returns them oldest first in JSON format.
+func GetEnrollmentsByStudentId(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getEnrollments: %v", err)})
+		return
+	}
+
+	rows, err := db.Query(`SELECT Enrollments.ID, Enrollments.Student_ID, Enrollments.Tournament_ID, Enrollments.House_ID,
+								COALESCE(SUM(Student_House_Points.Points), 0), Enrollments.Enrolled_At
+							FROM Enrollments
+							LEFT JOIN Houses ON Houses.Tournament_ID = Enrollments.Tournament_ID
+							LEFT JOIN Student_House_Points ON Student_House_Points.House_ID = Houses.ID AND Student_House_Points.Student_ID = Enrollments.Student_ID
+							WHERE Enrollments.Student_ID = ?
+							GROUP BY Enrollments.ID, Enrollments.Student_ID, Enrollments.Tournament_ID, Enrollments.House_ID, Enrollments.Enrolled_At
+							ORDER BY Enrollments.Enrolled_At, Enrollments.ID`, parsedID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getEnrollments: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	enrollments := []models.Enrollment{}
+	// Loop through rows, using Scan to assign column data to struct fields.
+	for rows.Next() {
+		var enrollment models.Enrollment
+		if err := rows.Scan(&enrollment.ID, &enrollment.Student_ID, &enrollment.Tournament_ID, &enrollment.House_ID, &enrollment.Points, &enrollment.Enrolled_At); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getEnrollments: %v", err)})
+			return
+		}
+		enrollments = append(enrollments, enrollment)
+	}
+	if err := rows.Err(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getEnrollments: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, enrollments)
+}
+
+// PostEnrollmentByStudentId enrolls an existing student in another tournament.
+// It takes the student ID as a URL parameter and the house to join from the JSON payload, enrolls the student
+// in that house's tournament and makes it their current house. A student can only be enrolled once per tournament;
+// moving between houses of the same tournament goes through TransferStudentById.
+// It returns the created enrollment in JSON format.
+func PostEnrollmentByStudentId(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("postEnrollment: %v", err)})
+		return
+	}
+
+	var request struct {
+		House_ID *int64 `json:"house_id" binding:"required"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postEnrollment: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := checkVersion(tx, "Students", parsedID, nil); err != nil {
+		respondWriteError(c, "postEnrollment", err)
+		return
+	}
+
+	enrollment := models.Enrollment{Student_ID: parsedID, House_ID: *request.House_ID}
+	err = tx.QueryRow("SELECT Tournament_ID FROM Houses WHERE ID = ?", enrollment.House_ID).Scan(&enrollment.Tournament_ID)
+	if err == sql.ErrNoRows {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("house %d not found", enrollment.House_ID)})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postEnrollment: %v", err)})
+		return
+	}
+
+	var existing int64
+	err = tx.QueryRow("SELECT House_ID FROM Enrollments WHERE Student_ID = ? AND Tournament_ID = ?", parsedID, enrollment.Tournament_ID).Scan(&existing)
+	if err == nil {
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("postEnrollment: student is already enrolled in tournament %d through house %d", enrollment.Tournament_ID, existing)})
+		return
+	}
+	if err != sql.ErrNoRows {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postEnrollment: %v", err)})
+		return
+	}
+
+	if err := enrollStudent(tx, parsedID, enrollment.House_ID); err != nil {
+		respondWriteError(c, "postEnrollment", err)
+		return
+	}
+
+	err = tx.QueryRow("SELECT ID, Enrolled_At FROM Enrollments WHERE Student_ID = ? AND Tournament_ID = ?", parsedID, enrollment.Tournament_ID).Scan(&enrollment.ID, &enrollment.Enrolled_At)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postEnrollment: %v", err)})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postEnrollment: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, enrollment)
+}
@@ -0,0 +1,279 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for exporting the points ledger and standings of the house-cup application as spreadsheets.
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/spreadsheet"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportFlushRows is how many rows are written between flushes to the client.
+const exportFlushRows = 500
+
+// exportFilter builds the WHERE clause of an export from its query parameters.
+type exportFilter struct {
+	conditions []string
+	args       []interface{}
+}
+
+func (f *exportFilter) add(condition string, arg interface{}) {
+	f.conditions = append(f.conditions, condition)
+	f.args = append(f.args, arg)
+}
+
+func (f *exportFilter) where() string {
+	if len(f.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.conditions, " AND ")
+}
+
+// addID adds condition when the query parameter name is present. It reports an invalid ID with a 400 response.
+func (f *exportFilter) addID(c *gin.Context, op string, name string, condition string) bool {
+	value := c.Query(name)
+	if value == "" {
+		return true
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: invalid %s %q", op, name, value)})
+		return false
+	}
+	f.add(condition, id)
+	return true
+}
+
+// addTimeRange adds the from and to query parameters, given as dates or RFC 3339 timestamps, as bounds on column.
+// A date in to includes that whole day.
+func (f *exportFilter) addTimeRange(c *gin.Context, op string, column string) bool {
+	for _, name := range []string{"from", "to"} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+
+		bound, err := time.Parse(time.RFC3339, value)
+		dateOnly := false
+		if err != nil {
+			bound, err = time.Parse("2006-01-02", value)
+			dateOnly = true
+		}
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: invalid %s %q, use YYYY-MM-DD or RFC 3339", op, name, value)})
+			return false
+		}
+
+		switch {
+		case name == "from":
+			f.add(column+" >= ?", bound.UTC().Format("2006-01-02 15:04:05"))
+		case dateOnly:
+			f.add(column+" < ?", bound.AddDate(0, 0, 1).Format("2006-01-02 15:04:05"))
+		default:
+			f.add(column+" <= ?", bound.UTC().Format("2006-01-02 15:04:05"))
+		}
+	}
+	return true
+}
+
+// streamExport writes the header and every row of rows to the client in the format named by the format
+// query parameter, csv by default, flushing as it goes so the export is never held in memory.
+// scan reads the current row into the values of one spreadsheet row.
+// Once streaming has started the status can no longer change, so later errors are logged and end the download early.
+func streamExport(c *gin.Context, op string, filename string, header []interface{}, rows *sql.Rows, scan func(*sql.Rows) ([]interface{}, error)) {
+	defer rows.Close()
+
+	format := c.DefaultQuery("format", spreadsheet.CSV)
+	if format != spreadsheet.CSV && format != spreadsheet.XLSX {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: format must be %q or %q", op, spreadsheet.CSV, spreadsheet.XLSX)})
+		return
+	}
+
+	c.Header("Content-Type", spreadsheet.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+"."+format))
+	c.Status(http.StatusOK)
+
+	writer, err := spreadsheet.NewWriter(c.Writer, format, filename)
+	if err == nil {
+		err = writer.WriteRow(header...)
+	}
+	for count := 1; err == nil && rows.Next(); count++ {
+		var values []interface{}
+		values, err = scan(rows)
+		if err == nil {
+			err = writer.WriteRow(values...)
+		}
+		if err == nil && count%exportFlushRows == 0 {
+			err = writer.Flush()
+			c.Writer.Flush()
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		log.Print(op, ": ", err)
+	}
+}
+
+// ExportPoints streams the points ledger as a CSV or XLSX spreadsheet.
+// It takes optional tournament_id, house_id, student_id, kind and category query parameters and a from/to date range
+// to filter the ledger, and the format query parameter (csv or xlsx). Rows are ordered by their ID.
+// Points is the effective amount; Raw Points is the amount awarded before the listed multipliers applied.
+func ExportPoints(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	var filter exportFilter
+	if !filter.addID(c, "exportPoints", "tournament_id", "Houses.Tournament_ID = ?") ||
+		!filter.addID(c, "exportPoints", "house_id", "Points.House_ID = ?") ||
+		!filter.addID(c, "exportPoints", "student_id", "Points.Student_ID = ?") ||
+		!filter.addTimeRange(c, "exportPoints", "Points.Created_At") {
+		return
+	}
+	if kind := c.Query("kind"); kind != "" {
+		filter.add("Points.Kind = ?", kind)
+	}
+	if category := c.Query("category"); category != "" {
+		filter.add("Points.Category = ?", category)
+	}
+
+	rows, err := db.Query(`SELECT Points.ID, Points.Created_At, Tournaments.ID, Tournaments.Tournament_Name,
+								Houses.ID, Houses.House_Name, Points.Student_ID, Students.Student_Name, Points.Points, Points.Notes,
+								Points.Kind, Points.Reverses_ID, Points.Raw_Points, Points.Category, Points.Multiplier_IDs
+							FROM Points
+							JOIN Houses ON Points.House_ID = Houses.ID
+							LEFT JOIN Tournaments ON Houses.Tournament_ID = Tournaments.ID
+							LEFT JOIN Students ON Points.Student_ID = Students.ID`+filter.where()+`
+							ORDER BY Points.ID`, filter.args...)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("exportPoints: %v", err)})
+		return
+	}
+
+	header := []interface{}{"ID", "Created At", "Tournament ID", "Tournament", "House ID", "House", "Student ID", "Student", "Points", "Notes", "Kind", "Reverses ID",
+		"Raw Points", "Category", "Multiplier IDs"}
+	streamExport(c, "exportPoints", "points", header, rows, func(rows *sql.Rows) ([]interface{}, error) {
+		var id, houseID, points, rawPoints int64
+		var createdAt, houseName, kind string
+		var tournamentID, studentID, reversesID *int64
+		var tournamentName, studentName, notes, category, multiplierIDs *string
+		err := rows.Scan(&id, &createdAt, &tournamentID, &tournamentName, &houseID, &houseName, &studentID, &studentName, &points, &notes, &kind, &reversesID,
+			&rawPoints, &category, &multiplierIDs)
+		return []interface{}{id, createdAt, tournamentID, tournamentName, houseID, houseName, studentID, studentName, points, notes, kind, reversesID,
+			rawPoints, category, multiplierIDs}, err
+	})
+}
+
+// ExportHouseStandings streams the house standings as a CSV or XLSX spreadsheet.
+// It takes an optional tournament_id query parameter and the format query parameter (csv or xlsx).
+// Houses are ranked by their points within each tournament; tied houses share a rank.
+func ExportHouseStandings(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	var filter exportFilter
+	if !filter.addID(c, "exportHouseStandings", "tournament_id", "Houses.Tournament_ID = ?") {
+		return
+	}
+
+	rows, err := db.Query(`SELECT Tournaments.ID, Tournaments.Tournament_Name, Houses.ID, Houses.House_Name, Houses.House_Points
+							FROM Houses
+							LEFT JOIN Tournaments ON Houses.Tournament_ID = Tournaments.ID`+filter.where()+`
+							ORDER BY Houses.Tournament_ID, Houses.House_Points DESC, Houses.ID`, filter.args...)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("exportHouseStandings: %v", err)})
+		return
+	}
+
+	var ranks standingRanks
+	header := []interface{}{"Tournament ID", "Tournament", "Rank", "House ID", "House", "Points"}
+	streamExport(c, "exportHouseStandings", "house-standings", header, rows, func(rows *sql.Rows) ([]interface{}, error) {
+		var houseID, points int64
+		var houseName string
+		var tournamentID *int64
+		var tournamentName *string
+		err := rows.Scan(&tournamentID, &tournamentName, &houseID, &houseName, &points)
+		return []interface{}{tournamentID, tournamentName, ranks.next(tournamentID, points), houseID, houseName, points}, err
+	})
+}
+
+// ExportStudentStandings streams the student standings as a CSV or XLSX spreadsheet.
+// With the tournament_id query parameter students are ranked by the points they earned in that tournament,
+// otherwise by their points in the tournament of their current house. It also takes the format query parameter (csv or xlsx); tied students share a rank.
+func ExportStudentStandings(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	var rows *sql.Rows
+	var err error
+	if value := c.Query("tournament_id"); value != "" {
+		tournamentID, parseErr := strconv.ParseInt(value, 10, 64)
+		if parseErr != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("exportStudentStandings: invalid tournament_id %q", value)})
+			return
+		}
+		rows, err = db.Query(`SELECT Students.ID, Students.Student_Name, Students.External_ID, Enrollments.House_ID, Current.House_Name,
+									COALESCE(SUM(Student_House_Points.Points), 0) AS Total
+								FROM Enrollments
+								JOIN Students ON Students.ID = Enrollments.Student_ID
+								JOIN Houses AS Current ON Current.ID = Enrollments.House_ID
+								JOIN Houses ON Houses.Tournament_ID = Enrollments.Tournament_ID
+								LEFT JOIN Student_House_Points ON Student_House_Points.House_ID = Houses.ID AND Student_House_Points.Student_ID = Students.ID
+								WHERE Enrollments.Tournament_ID = ? AND Students.Deleted_At IS NULL
+								GROUP BY Students.ID, Students.Student_Name, Students.External_ID, Enrollments.House_ID, Current.House_Name
+								ORDER BY Total DESC, Students.ID`, tournamentID)
+	} else {
+		rows, err = db.Query(`SELECT Students.ID, Students.Student_Name, Students.External_ID, Students.House_ID, Houses.House_Name, Students.Points
+								FROM Students
+								LEFT JOIN Houses ON Students.House_ID = Houses.ID
+								WHERE Students.Deleted_At IS NULL
+								ORDER BY Students.Points DESC, Students.ID`)
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("exportStudentStandings: %v", err)})
+		return
+	}
+
+	var ranks standingRanks
+	header := []interface{}{"Rank", "Student ID", "Student", "External ID", "House ID", "House", "Points"}
+	streamExport(c, "exportStudentStandings", "student-standings", header, rows, func(rows *sql.Rows) ([]interface{}, error) {
+		var studentID, points int64
+		var studentName string
+		var externalID, houseName *string
+		var houseID *int64
+		err := rows.Scan(&studentID, &studentName, &externalID, &houseID, &houseName, &points)
+		return []interface{}{ranks.next(nil, points), studentID, studentName, externalID, houseID, houseName, points}, err
+	})
+}
+
+// standingRanks assigns competition ranks ("1224") to rows ordered by points within each group.
+type standingRanks struct {
+	started  bool
+	group    *int64
+	position int
+	rank     int
+	points   int64
+}
+
+func (r *standingRanks) next(group *int64, points int64) int {
+	sameGroup := r.started && ((r.group == nil && group == nil) || (r.group != nil && group != nil && *r.group == *group))
+	if !sameGroup {
+		r.position, r.rank = 0, 0
+	}
+	r.position++
+	if !sameGroup || points != r.points {
+		r.rank = r.position
+	}
+	r.started, r.group, r.points = true, group, points
+	return r.rank
+}
@@ -0,0 +1,32 @@
+package controllers
+
+import "testing"
+
+func TestStandingRanks(t *testing.T) {
+	one, two := int64(1), int64(2)
+	tests := []struct {
+		group  *int64
+		points int64
+		want   int
+	}{
+		// Competition ranking within a group: 1224
+		{&one, 30, 1},
+		{&one, 20, 2},
+		{&one, 20, 2},
+		{&one, 10, 4},
+		// A new group starts over, even on the same points
+		{&two, 10, 1},
+		{&two, 10, 1},
+		{&two, 5, 3},
+		// Rows without a group form one group
+		{nil, 5, 1},
+		{nil, 5, 1},
+		{nil, 0, 3},
+	}
+	var ranks standingRanks
+	for i, test := range tests {
+		if got := ranks.next(test.group, test.points); got != test.want {
+			t.Errorf("row %d: rank %d, want %d", i, got, test.want)
+		}
+	}
+}
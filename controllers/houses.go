@@ -3,6 +3,9 @@
 package controllers
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -30,7 +33,7 @@ func GetHouses(c *gin.Context) {
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var house models.House
-		if err := rows.Scan(&house.ID, &house.House_Name, &house.House_Points, &house.Tournament_ID); err != nil {
+		if err := rows.Scan(&house.ID, &house.House_Name, &house.House_Points, &house.Tournament_ID, &house.Version); err != nil {
 			log.Print(err)
 			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Errorf("getHouses: %v", err)})
 		}
@@ -66,7 +69,7 @@ func GetHousesByTournamentId(c *gin.Context) {
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var house models.House
-		if err := rows.Scan(&house.ID, &house.House_Name, &house.House_Points, &house.Tournament_ID); err != nil {
+		if err := rows.Scan(&house.ID, &house.House_Name, &house.House_Points, &house.Tournament_ID, &house.Version); err != nil {
 			log.Print(err)
 			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Errorf("getHouses: %v", err)})
 		}
@@ -109,9 +112,107 @@ func PostHouseByTournamentId(c *gin.Context) {
 	return
 }
 
-// UpdateHouseById updates a specific house by its ID.
+// houseCreation is the payload of a new house.
+type houseCreation struct {
+	House_Name *string `json:"house_name" binding:"required"`
+}
+
+// CreateHouseByTournamentId creates a new house with no points in a specific tournament.
+// It takes the tournament ID as a URL parameter and the house name from the JSON payload,
+// and returns the created house with its ETag in JSON format.
+func CreateHouseByTournamentId(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	parsedID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("postHouse: %v", err)})
+		return
+	}
+
+	var request houseCreation
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postHouse: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := checkVersion(tx, "Tournaments", parsedID, nil); err != nil {
+		respondWriteError(c, "postHouse", err)
+		return
+	}
+
+	house := models.House{House_Name: *request.House_Name, Tournament_ID: parsedID, Version: 1}
+	result, err := tx.Exec("INSERT INTO Houses (house_name, house_points, tournament_id) VALUES (?, 0, ?)", house.House_Name, parsedID)
+	if err == nil {
+		house.ID, err = result.LastInsertId()
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondWriteError(c, "postHouse", err)
+		return
+	}
+
+	c.Header("ETag", etag(house.Version))
+	c.IndentedJSON(http.StatusCreated, house)
+}
+
+// errHouseTournament reports an update that tried to move a house to another tournament.
+var errHouseTournament = errors.New("houses stay in their tournament, clone the tournament to reuse its houses")
+
+// rejectTournamentChange returns errHouseTournament when tournamentID differs from the tournament of the house
+// identified by id. The house's enrollments, ledger history and its students' totals all belong to its tournament.
+func rejectTournamentChange(q querier, id int64, tournamentID *int64) error {
+	var same bool
+	err := q.QueryRow("SELECT Tournament_ID <=> ? FROM Houses WHERE ID = ?", tournamentID, id).Scan(&same)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !same {
+		return errHouseTournament
+	}
+	return nil
+}
+
+// dropUnchangedTournament removes the tournament_id member from a house merge patch when it matches the house
+// identified by id, and returns errHouseTournament when it would change it.
+func dropUnchangedTournament(q querier, patch map[string]json.RawMessage, id int64) error {
+	raw, ok := patch["tournament_id"]
+	if !ok {
+		return nil
+	}
+	var tournamentID *int64
+	if err := json.Unmarshal(raw, &tournamentID); err != nil {
+		return &patchError{fmt.Sprintf("field %q: %v", "tournament_id", err)}
+	}
+	if err := rejectTournamentChange(q, id, tournamentID); err != nil {
+		return err
+	}
+	delete(patch, "tournament_id")
+	return nil
+}
+
+// houseReplacement is the payload of a full house update; every field must be supplied.
+type houseReplacement struct {
+	House_Name    *string `json:"house_name" binding:"required"`
+	House_Points  *int64  `json:"house_points" binding:"required"`
+	Tournament_ID *int64  `json:"tournament_id" binding:"required"`
+}
+
+// UpdateHouseById replaces a specific house by its ID.
 // It takes the house ID as a URL parameter, parses the JSON payload from the request,
-// updates the corresponding house in the database, and returns the updated house in JSON format.
+// rejects it if a required field is missing, updates the corresponding house in the database,
+// and returns the updated house in JSON format. House points follow the points ledger and must be left as they are,
+// and so must the tournament the house belongs to.
 func UpdateHouseById(c *gin.Context) {
 	db := config.ConnectToDB()
 	id := c.Param("id")
@@ -122,26 +223,188 @@ func UpdateHouseById(c *gin.Context) {
 		log.Print(err)
 	}
 
-	var newHouse models.House
+	var newHouse houseReplacement
 
 	if err := c.BindJSON(&newHouse); err != nil {
 		log.Print("ERROR: ", err)
 		return
 	}
-	rows, err := db.Query("UPDATE Houses SET house_name = ?, house_points = ?, tournament_id = ? WHERE id = ?", newHouse.House_Name, newHouse.House_Points, newHouse.Tournament_ID, parsedID)
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("updateHouse: %v", err)})
+		return
+	}
+
+	// The house's points follow the ledger and are only checked, never written
+	if err := rejectTotalChange(db, "Houses", "House_Points", parsedID, *newHouse.House_Points); err != nil {
+		respondWriteError(c, "updateHouse", err)
+		return
+	}
+	if err := rejectTournamentChange(db, parsedID, newHouse.Tournament_ID); err != nil {
+		respondWriteError(c, "updateHouse", err)
+		return
+	}
+
+	query := "UPDATE Houses SET house_name = ?, version = version + 1 WHERE id = ?"
+	args := []interface{}{newHouse.House_Name, parsedID}
+	if ifMatch != nil {
+		query += " AND version = ?"
+		args = append(args, *ifMatch)
+	}
+
+	result, err := db.Exec(query, args...)
 
 	if err != nil {
 		log.Print(err)
+		respondWriteError(c, "updateHouse", err)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = checkVersion(db, "Houses", parsedID, ifMatch)
+		}
+		respondWriteError(c, "updateHouse", err)
+		return
 	}
 
 	row := db.QueryRow("SELECT * FROM Houses where id = ?", parsedID)
 	var updatedHouse models.House
-	if err := row.Scan(&updatedHouse.ID, &updatedHouse.House_Name, &updatedHouse.House_Points, &updatedHouse.Tournament_ID); err != nil {
+	if err := row.Scan(&updatedHouse.ID, &updatedHouse.House_Name, &updatedHouse.House_Points, &updatedHouse.Tournament_ID, &updatedHouse.Version); err != nil {
 		log.Print(err)
 	}
-	defer rows.Close()
 
 	log.Print(updatedHouse)
+	c.Header("ETag", etag(updatedHouse.Version))
 	c.IndentedJSON(http.StatusOK, updatedHouse)
 	return
 }
+
+// GetHouseById retrieves a specific house by its ID.
+// It takes the house ID as a URL parameter, queries the database for the corresponding house,
+// and returns the result in JSON format.
+func GetHouseById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getHouse: %v", err)})
+		return
+	}
+
+	row := db.QueryRow("SELECT * FROM Houses WHERE ID = ?", parsedID)
+	var house models.House
+	err = row.Scan(&house.ID, &house.House_Name, &house.House_Points, &house.Tournament_ID, &house.Version)
+	if err == sql.ErrNoRows {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("house %d not found", parsedID)})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getHouse: %v", err)})
+		return
+	}
+
+	c.Header("ETag", etag(house.Version))
+	c.IndentedJSON(http.StatusOK, house)
+}
+
+// DeleteHouseById deletes a house together with its enrollments.
+// It takes the house ID as a URL parameter and, inside a single transaction, removes the house's enrollments
+// and the house. Houses that were awarded points are kept along with their ledger history and are refused with a conflict.
+// Its students are kept and fall back to their latest other house. It responds with a JSON message indicating success.
+func DeleteHouseById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteHouse: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteHouse: %v", err)})
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteHouse: %v", err)})
+		return
+	}
+
+	if err := checkVersion(tx, "Houses", parsedID, ifMatch); err != nil {
+		tx.Rollback()
+		respondWriteError(c, "deleteHouse", err)
+		return
+	}
+
+	if err := removeHouses(tx, "ID = ?", parsedID); err != nil {
+		tx.Rollback()
+		respondWriteError(c, "deleteHouse", err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteHouse: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "House and associated enrollments deleted successfully"})
+}
+
+// PatchHouseById partially updates a specific house by its ID.
+// It takes the house ID as a URL parameter, applies the JSON Merge Patch payload from the request
+// so that only the supplied fields change, and returns the updated house in JSON format.
+// House points follow the points ledger and, like the house's tournament, may only be supplied unchanged.
+func PatchHouseById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchHouse: %v", err)})
+		return
+	}
+
+	patch, err := readMergePatch(c.Request.Body)
+	if err != nil {
+		respondWriteError(c, "patchHouse", err)
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchHouse: %v", err)})
+		return
+	}
+
+	if err := dropUnchangedTotal(db, patch, "house_points", "Houses", "House_Points", parsedID); err != nil {
+		respondWriteError(c, "patchHouse", err)
+		return
+	}
+	if err := dropUnchangedTournament(db, patch, parsedID); err != nil {
+		respondWriteError(c, "patchHouse", err)
+		return
+	}
+
+	if err := applyMergePatch(db, "Houses", parsedID, patch, housePatchFields, ifMatch); err != nil {
+		respondWriteError(c, "patchHouse", err)
+		return
+	}
+
+	row := db.QueryRow("SELECT * FROM Houses where id = ?", parsedID)
+	var updatedHouse models.House
+	if err := row.Scan(&updatedHouse.ID, &updatedHouse.House_Name, &updatedHouse.House_Points, &updatedHouse.Tournament_ID, &updatedHouse.Version); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("patchHouse: %v", err)})
+		return
+	}
+
+	c.Header("ETag", etag(updatedHouse.Version))
+	c.IndentedJSON(http.StatusOK, updatedHouse)
+}
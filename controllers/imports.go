@@ -0,0 +1,330 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for importing student rosters into the house-cup application.
+package controllers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rosterColumns names the CSV header of each roster field. Only the name column is required.
+type rosterColumns struct {
+	name       string
+	house      string
+	externalID string
+}
+
+// rosterUnassigned warns about a roster row without a house, whose student is not enrolled in the tournament.
+const rosterUnassigned = "unassigned, not enrolled"
+
+// rosterRow is a student read from a roster file, along with the line it came from and any warning about it.
+type rosterRow struct {
+	Line int `json:"line"`
+	models.Student
+	Warning string `json:"warning,omitempty"`
+}
+
+// importError reports a problem with one line of a roster file.
+type importError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// rosterHouses resolves the house column of a roster to the houses of one tournament.
+// Values that parse as integers are house IDs, anything else is matched against house names ignoring case.
+type rosterHouses struct {
+	ids   map[int64]bool
+	names map[string][]int64
+}
+
+func (h rosterHouses) resolve(value string) (int64, error) {
+	if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if !h.ids[id] {
+			return 0, fmt.Errorf("house %d is not part of this tournament", id)
+		}
+		return id, nil
+	}
+
+	matches := h.names[strings.ToLower(value)]
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("no house named %q in this tournament", value)
+	case 1:
+		return matches[0], nil
+	default:
+		return 0, fmt.Errorf("house name %q is ambiguous, use its ID", value)
+	}
+}
+
+// dryRunParam reads the dry_run form field, or query parameter, of an import request.
+func dryRunParam(c *gin.Context) (bool, error) {
+	value := c.DefaultPostForm("dry_run", c.Query("dry_run"))
+	if value == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid dry_run %q", value)
+	}
+	return dryRun, nil
+}
+
+// loadRosterHouses loads the houses of a tournament for resolving roster house columns.
+func loadRosterHouses(db *sql.DB, tournamentID int64) (rosterHouses, error) {
+	houses := rosterHouses{ids: map[int64]bool{}, names: map[string][]int64{}}
+	rows, err := db.Query("SELECT ID, House_Name FROM Houses WHERE Tournament_ID = ?", tournamentID)
+	if err != nil {
+		return houses, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var houseID int64
+		var houseName string
+		if err := rows.Scan(&houseID, &houseName); err != nil {
+			return houses, err
+		}
+		houses.ids[houseID] = true
+		houses.names[strings.ToLower(houseName)] = append(houses.names[strings.ToLower(houseName)], houseID)
+	}
+	return houses, rows.Err()
+}
+
+// parseRoster reads a roster CSV with a header line and validates every row.
+// Problems with individual rows are collected so they can be reported together;
+// the returned error is only set when the file cannot be read as a roster at all.
+func parseRoster(r io.Reader, columns rosterColumns, houses rosterHouses) ([]rosterRow, []importError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("roster file is empty")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		// Spreadsheet exports often start with a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		index[name] = i
+	}
+	field := func(record []string, column string) (string, bool) {
+		i, ok := index[strings.ToLower(column)]
+		if !ok || i >= len(record) {
+			return "", false
+		}
+		return strings.TrimSpace(record[i]), true
+	}
+	if _, ok := index[strings.ToLower(columns.name)]; !ok {
+		return nil, nil, fmt.Errorf("roster file has no %q column", columns.name)
+	}
+
+	var rows []rosterRow
+	var problems []importError
+	seen := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// The reader cannot resynchronise after a malformed line, so stop here
+			problems = append(problems, importError{Line: parseErr.Line, Message: parseErr.Err.Error()})
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if len(record) != len(header) {
+			problems = append(problems, importError{Line: line, Message: fmt.Sprintf("expected %d fields, found %d", len(header), len(record))})
+			continue
+		}
+
+		row := rosterRow{Line: line}
+		row.Student.Student_Name, _ = field(record, columns.name)
+		if row.Student.Student_Name == "" {
+			problems = append(problems, importError{Line: line, Column: columns.name, Message: "name is required"})
+		}
+
+		if value, ok := field(record, columns.house); ok && value != "" {
+			houseID, err := houses.resolve(value)
+			if err != nil {
+				problems = append(problems, importError{Line: line, Column: columns.house, Message: err.Error()})
+			} else {
+				row.Student.House_ID = &houseID
+			}
+		} else {
+			row.Warning = rosterUnassigned
+		}
+
+		if value, ok := field(record, columns.externalID); ok && value != "" {
+			if first, duplicate := seen[value]; duplicate {
+				problems = append(problems, importError{Line: line, Column: columns.externalID, Message: fmt.Sprintf("external ID %q already used on line %d", value, first)})
+			} else {
+				seen[value] = line
+				externalID := value
+				row.Student.External_ID = &externalID
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, problems, nil
+}
+
+// ImportStudentsByTournamentId creates students from a roster CSV uploaded as multipart form data.
+// It takes the tournament ID as a URL parameter and reads the roster from the "file" form field.
+// The name_column, house_column and external_id_column form fields name the CSV columns holding each student's
+// name, house (an ID or a house name of this tournament) and external ID; they default to "name", "house" and "external_id".
+// Every row is validated first and all problems are reported with their line numbers. With dry_run set nothing
+// is written and the students that would be created are returned; otherwise they are all created in a single
+// transaction, or none are. Students are enrolled in the tournament through their house: rows without a house
+// create unassigned students who are not enrolled in it, which is reported as a warning on each of those rows
+// and counted as unassigned. It returns the created students in JSON format.
+func ImportStudentsByTournamentId(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+		return
+	}
+
+	dryRun, err := dryRunParam(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+		return
+	}
+
+	columns := rosterColumns{
+		name:       c.DefaultPostForm("name_column", "name"),
+		house:      c.DefaultPostForm("house_column", "house"),
+		externalID: c.DefaultPostForm("external_id_column", "external_id"),
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+		return
+	}
+	defer file.Close()
+
+	if err := checkVersion(db, "Tournaments", parsedID, nil); err != nil {
+		respondWriteError(c, "importStudents", err)
+		return
+	}
+
+	houses, err := loadRosterHouses(db, parsedID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+		return
+	}
+
+	roster, problems, err := parseRoster(file, columns, houses)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+		return
+	}
+
+	// External IDs must not belong to a student that already exists
+	var externalIDs []interface{}
+	lines := map[string]int{}
+	for _, row := range roster {
+		if row.External_ID != nil {
+			externalIDs = append(externalIDs, *row.External_ID)
+			lines[*row.External_ID] = row.Line
+		}
+	}
+	if len(externalIDs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(externalIDs)), ", ")
+		rows, err := db.Query("SELECT ID, External_ID FROM Students WHERE External_ID IN ("+placeholders+")", externalIDs...)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+			return
+		}
+		for rows.Next() {
+			var studentID int64
+			var externalID string
+			if err := rows.Scan(&studentID, &externalID); err != nil {
+				rows.Close()
+				c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+				return
+			}
+			problems = append(problems, importError{Line: lines[externalID], Column: columns.externalID, Message: fmt.Sprintf("external ID %q already belongs to student %d", externalID, studentID)})
+		}
+		rows.Close()
+	}
+
+	if len(problems) > 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": "importStudents: roster has errors, nothing was imported", "dry_run": dryRun, "errors": problems})
+		return
+	}
+	if roster == nil {
+		roster = []rosterRow{}
+	}
+	if dryRun {
+		c.IndentedJSON(http.StatusOK, gin.H{"dry_run": true, "students": roster, "unassigned": countUnassigned(roster)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+		return
+	}
+
+	for i, row := range roster {
+		roster[i].ID, err = insertStudent(tx, row.Student)
+		if err != nil {
+			// Rollback the transaction in case of an error
+			tx.Rollback()
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importStudents: line %d: %v", row.Line, err)})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importStudents: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"dry_run": false, "students": roster, "unassigned": countUnassigned(roster)})
+}
+
+// countUnassigned counts the roster rows without a house.
+func countUnassigned(roster []rosterRow) int {
+	unassigned := 0
+	for _, row := range roster {
+		if row.House_ID == nil {
+			unassigned++
+		}
+	}
+	return unassigned
+}
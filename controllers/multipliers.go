@@ -0,0 +1,362 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for managing the time-boxed points multipliers in the house-cup application.
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// multiplierColumns lists the Multipliers columns in the order scanMultiplier reads them.
+const multiplierColumns = "ID, Multiplier_Name, Factor, Tournament_ID, House_ID, Category, Starts_At, Ends_At, Created_At, Version"
+
+// errMultiplierApplied reports a multiplier that cannot be deleted because points records were multiplied by it.
+var errMultiplierApplied = errors.New("multiplier was applied to points records, end it instead")
+
+// scanMultiplier reads a row of multiplierColumns.
+func scanMultiplier(row interface{ Scan(...interface{}) error }) (models.Multiplier, error) {
+	var multiplier models.Multiplier
+	err := row.Scan(&multiplier.ID, &multiplier.Multiplier_Name, &multiplier.Factor, &multiplier.Tournament_ID, &multiplier.House_ID,
+		&multiplier.Category, &multiplier.Starts_At, &multiplier.Ends_At, &multiplier.Created_At, &multiplier.Version)
+	return multiplier, err
+}
+
+// multiplierTime parses an RFC 3339 timestamp into the UTC form MySQL stores.
+func multiplierTime(value string) (string, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp %q, use RFC 3339", value)
+	}
+	return parsed.UTC().Format("2006-01-02 15:04:05"), nil
+}
+
+// multiplierFactor rounds factor to the three decimals of the Factor column and checks that the stored value
+// is positive and fits the column.
+func multiplierFactor(factor float64) (string, error) {
+	stored := strconv.FormatFloat(factor, 'f', 3, 64)
+	rounded, err := strconv.ParseFloat(stored, 64)
+	if err != nil || !(rounded > 0 && rounded < 1000) {
+		return "", fmt.Errorf("factor must be between 0.001 and 999.999")
+	}
+	return stored, nil
+}
+
+// timeField decodes an RFC 3339 timestamp member.
+func timeField(raw json.RawMessage) (interface{}, error) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return multiplierTime(value)
+}
+
+// factorField decodes the factor member of a multiplier patch.
+func factorField(raw json.RawMessage) (interface{}, error) {
+	var value float64
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return multiplierFactor(value)
+}
+
+// multiplierPatchFields are the fields accepted by PatchMultiplierById.
+var multiplierPatchFields = map[string]patchField{
+	"multiplier_name": {column: "Multiplier_Name", decode: stringField},
+	"factor":          {column: "Factor", decode: factorField},
+	"tournament_id":   {column: "Tournament_ID", nullable: true, decode: intField},
+	"house_id":        {column: "House_ID", nullable: true, decode: intField},
+	"category":        {column: "Category", nullable: true, decode: stringField},
+	"starts_at":       {column: "Starts_At", decode: timeField},
+	"ends_at":         {column: "Ends_At", decode: timeField},
+}
+
+// multiplierRequest is the payload of a new multiplier.
+type multiplierRequest struct {
+	Multiplier_Name string  `json:"multiplier_name" binding:"required"`
+	Factor          float64 `json:"factor" binding:"required"`
+	Tournament_ID   *int64  `json:"tournament_id"`
+	House_ID        *int64  `json:"house_id"`
+	Category        *string `json:"category"`
+	Starts_At       string  `json:"starts_at" binding:"required"`
+	Ends_At         string  `json:"ends_at" binding:"required"`
+}
+
+// checkMultiplierScope checks that the multiplier identified by id, when scoped to both a tournament
+// and a house, names a house of that tournament. It returns a *patchError otherwise.
+func checkMultiplierScope(q querier, id int64) error {
+	var tournamentID, houseID, houseTournamentID sql.NullInt64
+	err := q.QueryRow(`SELECT Multipliers.Tournament_ID, Multipliers.House_ID, Houses.Tournament_ID
+						FROM Multipliers LEFT JOIN Houses ON Houses.ID = Multipliers.House_ID
+						WHERE Multipliers.ID = ?`, id).Scan(&tournamentID, &houseID, &houseTournamentID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("multiplier %d: %w", id, errNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if tournamentID.Valid && houseID.Valid && tournamentID != houseTournamentID {
+		return &patchError{fmt.Sprintf("house %d is not part of tournament %d", houseID.Int64, tournamentID.Int64)}
+	}
+	return nil
+}
+
+// GetMultipliers retrieves the points multipliers from the database.
+// It takes optional tournament_id and house_id query parameters, which also match multipliers that are not
+// scoped to a tournament or house, and an optional active query parameter that keeps only the multipliers
+// in effect now (true) or not in effect now (false).
+// It returns the multipliers, oldest first, in JSON format.
+func GetMultipliers(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	var conditions []string
+	var args []interface{}
+	for _, scope := range []struct{ param, column string }{{"tournament_id", "Tournament_ID"}, {"house_id", "House_ID"}} {
+		value := c.Query(scope.param)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getMultipliers: invalid %s %q", scope.param, value)})
+			return
+		}
+		conditions = append(conditions, "("+scope.column+" IS NULL OR "+scope.column+" = ?)")
+		args = append(args, id)
+	}
+	if value := c.Query("active"); value != "" {
+		active, err := strconv.ParseBool(value)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getMultipliers: invalid active %q", value)})
+			return
+		}
+		inEffect := "(Starts_At <= CURRENT_TIMESTAMP AND Ends_At > CURRENT_TIMESTAMP)"
+		if !active {
+			inEffect = "NOT " + inEffect
+		}
+		conditions = append(conditions, inEffect)
+	}
+
+	query := "SELECT " + multiplierColumns + " FROM Multipliers"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := db.Query(query+" ORDER BY ID", args...)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getMultipliers: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	multipliers := []models.Multiplier{}
+	for rows.Next() {
+		multiplier, err := scanMultiplier(rows)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getMultipliers: %v", err)})
+			return
+		}
+		multipliers = append(multipliers, multiplier)
+	}
+	c.IndentedJSON(http.StatusOK, multipliers)
+}
+
+// GetMultiplierById retrieves a specific points multiplier by its ID.
+// It takes the multiplier ID as a URL parameter and returns the multiplier in JSON format.
+func GetMultiplierById(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	parsedID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getMultiplier: %v", err)})
+		return
+	}
+
+	multiplier, err := scanMultiplier(db.QueryRow("SELECT "+multiplierColumns+" FROM Multipliers WHERE ID = ?", parsedID))
+	if err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	if err != nil {
+		respondWriteError(c, "getMultiplier", err)
+		return
+	}
+	c.Header("ETag", etag(multiplier.Version))
+	c.IndentedJSON(http.StatusOK, multiplier)
+}
+
+// PostMultiplier creates a points multiplier, such as double points on a Friday or a handicap for one house.
+// It parses the name, the factor awards are multiplied by, the RFC 3339 times it starts and ends at and its
+// optional tournament, house and category scopes from the JSON payload. Awards made while the multiplier is
+// in effect and matching every scope it sets are multiplied by it.
+// It returns the new multiplier in JSON format.
+func PostMultiplier(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	var request multiplierRequest
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	factor, err := multiplierFactor(request.Factor)
+	var startsAt, endsAt string
+	if err == nil {
+		startsAt, err = multiplierTime(request.Starts_At)
+	}
+	if err == nil {
+		endsAt, err = multiplierTime(request.Ends_At)
+	}
+	if err == nil && endsAt <= startsAt {
+		err = fmt.Errorf("ends_at must be after starts_at")
+	}
+	if err == nil && strings.TrimSpace(request.Multiplier_Name) == "" {
+		err = fmt.Errorf("multiplier_name must not be empty")
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("postMultiplier: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postMultiplier: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO Multipliers (Multiplier_Name, Factor, Tournament_ID, House_ID, Category, Starts_At, Ends_At) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		request.Multiplier_Name, factor, request.Tournament_ID, request.House_ID, request.Category, startsAt, endsAt)
+	var id int64
+	if err == nil {
+		id, err = result.LastInsertId()
+	}
+	if err == nil {
+		err = checkMultiplierScope(tx, id)
+	}
+	if err != nil {
+		respondWriteError(c, "postMultiplier", err)
+		return
+	}
+
+	multiplier, err := scanMultiplier(tx.QueryRow("SELECT "+multiplierColumns+" FROM Multipliers WHERE ID = ?", id))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postMultiplier: %v", err)})
+		return
+	}
+	c.Header("ETag", etag(multiplier.Version))
+	c.IndentedJSON(http.StatusCreated, multiplier)
+}
+
+// PatchMultiplierById partially updates a specific points multiplier by its ID.
+// It takes the multiplier ID as a URL parameter and applies the JSON Merge Patch payload from the request,
+// which may change its name, factor, times and scopes (null removes a scope). Points already awarded keep
+// the amounts they were multiplied to; reverse and award them again to apply a corrected multiplier.
+// It returns the updated multiplier in JSON format.
+func PatchMultiplierById(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	parsedID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchMultiplier: %v", err)})
+		return
+	}
+
+	patch, err := readMergePatch(c.Request.Body)
+	if err != nil {
+		respondWriteError(c, "patchMultiplier", err)
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchMultiplier: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("patchMultiplier: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	err = applyMergePatch(tx, "Multipliers", parsedID, patch, multiplierPatchFields, ifMatch)
+	if err == nil {
+		err = checkMultiplierScope(tx, parsedID)
+	}
+	if err != nil {
+		respondWriteError(c, "patchMultiplier", err)
+		return
+	}
+
+	multiplier, err := scanMultiplier(tx.QueryRow("SELECT "+multiplierColumns+" FROM Multipliers WHERE ID = ?", parsedID))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("patchMultiplier: %v", err)})
+		return
+	}
+	c.Header("ETag", etag(multiplier.Version))
+	c.IndentedJSON(http.StatusOK, multiplier)
+}
+
+// DeleteMultiplierById deletes a points multiplier that was never applied.
+// A multiplier that was applied stays referenced by the points records it multiplied, so set its ends_at instead.
+// It takes the multiplier ID as a URL parameter and responds with a JSON message indicating success.
+func DeleteMultiplierById(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	parsedID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteMultiplier: %v", err)})
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteMultiplier: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteMultiplier: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := checkVersion(tx, "Multipliers", parsedID, ifMatch); err != nil {
+		respondWriteError(c, "deleteMultiplier", err)
+		return
+	}
+
+	var applied bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM Points WHERE FIND_IN_SET(?, Multiplier_IDs))", parsedID).Scan(&applied)
+	if err == nil && applied {
+		err = fmt.Errorf("multiplier %d: %w", parsedID, errMultiplierApplied)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM Multipliers WHERE ID = ?", parsedID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondWriteError(c, "deleteMultiplier", err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Multiplier deleted successfully"})
+}
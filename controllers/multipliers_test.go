@@ -0,0 +1,32 @@
+package controllers
+
+import "testing"
+
+func TestMultiplierFactor(t *testing.T) {
+	tests := []struct {
+		factor float64
+		want   string
+		valid  bool
+	}{
+		{1.5, "1.500", true},
+		{2, "2.000", true},
+		{0.001, "0.001", true},
+		{0.0005, "0.001", true},
+		{1.23456, "1.235", true},
+		{999.999, "999.999", true},
+		// Factors that round to zero would break the CHECK (Factor > 0) constraint
+		{0.0004, "", false},
+		{0.0001, "", false},
+		{0, "", false},
+		{-1, "", false},
+		// Factors that round to 1000 do not fit DECIMAL(6,3)
+		{999.9996, "", false},
+		{1000, "", false},
+	}
+	for _, test := range tests {
+		got, err := multiplierFactor(test.factor)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("multiplierFactor(%v) = %q, %v, want %q, valid %v", test.factor, got, err, test.want, test.valid)
+		}
+	}
+}
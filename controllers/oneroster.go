@@ -0,0 +1,394 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for importing OneRoster 1.1 CSV bundles into the house-cup application.
+package controllers
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions reported for each student of a OneRoster import.
+const (
+	oneRosterCreated   = "created"
+	oneRosterUpdated   = "updated"
+	oneRosterUnchanged = "unchanged"
+	oneRosterSkipped   = "skipped"
+)
+
+// oneRosterRecord is one data line of a OneRoster CSV file, keyed by its lower-cased header names.
+type oneRosterRecord struct {
+	line   int
+	fields map[string]string
+}
+
+// oneRosterStudent is a student user read from users.csv and the outcome of importing them.
+type oneRosterStudent struct {
+	Line         int      `json:"line"`
+	Sourced_ID   string   `json:"sourced_id"`
+	Student_ID   int64    `json:"student_id"`
+	Student_Name string   `json:"student_name"`
+	House_ID     *int64   `json:"house_id"`
+	Action       string   `json:"action"`
+	Warnings     []string `json:"warnings,omitempty"`
+}
+
+// active reports whether a OneRoster record is still in use; delta exports mark removed records "tobedeleted".
+func (r oneRosterRecord) active() bool {
+	return !strings.EqualFold(r.fields["status"], "tobedeleted")
+}
+
+// readOneRosterFile reads the CSV file called name from a OneRoster bundle, wherever it sits in the archive.
+// A missing file is an error only when it is required.
+func readOneRosterFile(archive *zip.Reader, name string, required bool) ([]oneRosterRecord, error) {
+	var file *zip.File
+	for _, candidate := range archive.File {
+		if strings.EqualFold(path.Base(candidate.Name), name) {
+			file = candidate
+			break
+		}
+	}
+	if file == nil {
+		if required {
+			return nil, fmt.Errorf("bundle has no %s", name)
+		}
+		return nil, nil
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer reader.Close()
+
+	parser := csv.NewReader(reader)
+	header, err := parser.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff")))
+	}
+
+	var records []oneRosterRecord
+	for {
+		record, err := parser.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		line, _ := parser.FieldPos(0)
+
+		fields := make(map[string]string, len(header))
+		for i, column := range header {
+			fields[column] = strings.TrimSpace(record[i])
+		}
+		records = append(records, oneRosterRecord{line: line, fields: fields})
+	}
+	return records, nil
+}
+
+// oneRosterNameMatches are the students without an external ID that share the name of a OneRoster user.
+type oneRosterNameMatches struct {
+	inScope    []models.Student
+	outOfScope []int64
+}
+
+// findOneRosterStudent locks and returns the student a OneRoster user maps to.
+// Students are matched on their external ID first. Otherwise a student created without one, for example through
+// PostStudents, is adopted when they are the only student of that name who either has no house or is enrolled in
+// the tournament, so re-imports never duplicate them. The other students of that name are returned unadopted.
+func findOneRosterStudent(tx *sql.Tx, tournamentID int64, sourcedID string, name string) (*models.Student, oneRosterNameMatches, error) {
+	var matches oneRosterNameMatches
+	var student models.Student
+	err := tx.QueryRow("SELECT ID, Student_Name, House_ID, Deleted_At FROM Students WHERE External_ID = ? FOR UPDATE", sourcedID).Scan(&student.ID, &student.Student_Name, &student.House_ID, &student.Deleted_At)
+	if err == nil {
+		student.External_ID = &sourcedID
+		return &student, matches, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, matches, err
+	}
+
+	rows, err := tx.Query(`SELECT ID, Student_Name, House_ID,
+								House_ID IS NULL OR EXISTS (SELECT 1 FROM Enrollments WHERE Enrollments.Student_ID = Students.ID AND Enrollments.Tournament_ID = ?)
+							FROM Students WHERE External_ID IS NULL AND Student_Name = ? AND Deleted_At IS NULL
+							ORDER BY ID FOR UPDATE`, tournamentID, name)
+	if err != nil {
+		return nil, matches, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var match models.Student
+		var inScope bool
+		if err := rows.Scan(&match.ID, &match.Student_Name, &match.House_ID, &inScope); err != nil {
+			return nil, matches, err
+		}
+		if inScope {
+			matches.inScope = append(matches.inScope, match)
+		} else {
+			matches.outOfScope = append(matches.outOfScope, match.ID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, matches, err
+	}
+	if len(matches.inScope) != 1 {
+		return nil, matches, nil
+	}
+	return &matches.inScope[0], matches, nil
+}
+
+// joinIDs formats IDs as a comma-separated list.
+func joinIDs(ids []int64) string {
+	formatted := make([]string, len(ids))
+	for i, id := range ids {
+		formatted[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// ImportOneRosterByTournamentId creates or updates students from a OneRoster 1.1 CSV bundle uploaded as multipart form data.
+// It takes the tournament ID as a URL parameter and reads the zip archive from the "file" form field.
+// Users with the student role in users.csv are keyed by their sourcedId, which is stored as the student's external ID,
+// so importing the same bundle again updates students instead of duplicating them. A student without an external ID
+// is adopted by name only when they are the only student of that name who has no house or is enrolled in this
+// tournament; users whose name matches several such students are skipped and reported. Points are never changed.
+// Classes are mapped to houses of the tournament by the optional class_map form field, a JSON object of class
+// sourcedIds to house IDs, or else by a class title matching a house name; students enrolled in a mapped class
+// are enrolled in its house unless they already have a house in this tournament.
+// With dry_run set the import is rolled back. It returns the outcome for every student in JSON format.
+func ImportOneRosterByTournamentId(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importOneRoster: %v", err)})
+		return
+	}
+
+	dryRun, err := dryRunParam(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importOneRoster: %v", err)})
+		return
+	}
+
+	classMap := map[string]int64{}
+	if value := c.PostForm("class_map"); value != "" {
+		if err := json.Unmarshal([]byte(value), &classMap); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importOneRoster: invalid class_map: %v", err)})
+			return
+		}
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importOneRoster: %v", err)})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importOneRoster: %v", err)})
+		return
+	}
+	defer file.Close()
+
+	archive, err := zip.NewReader(file, fileHeader.Size)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importOneRoster: %v", err)})
+		return
+	}
+
+	users, err := readOneRosterFile(archive, "users.csv", true)
+	var classes, enrollments []oneRosterRecord
+	if err == nil {
+		classes, err = readOneRosterFile(archive, "classes.csv", false)
+	}
+	if err == nil {
+		enrollments, err = readOneRosterFile(archive, "enrollments.csv", false)
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importOneRoster: %v", err)})
+		return
+	}
+
+	if err := checkVersion(db, "Tournaments", parsedID, nil); err != nil {
+		respondWriteError(c, "importOneRoster", err)
+		return
+	}
+	houses, err := loadRosterHouses(db, parsedID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importOneRoster: %v", err)})
+		return
+	}
+
+	var problems []importError
+
+	// Class titles that name a house of the tournament map to it, unless class_map says otherwise
+	classHouses := map[string]int64{}
+	for _, class := range classes {
+		if matches := houses.names[strings.ToLower(class.fields["title"])]; class.active() && len(matches) == 1 {
+			classHouses[class.fields["sourcedid"]] = matches[0]
+		}
+	}
+	for classID, houseID := range classMap {
+		if !houses.ids[houseID] {
+			problems = append(problems, importError{File: "class_map", Message: fmt.Sprintf("class %q: house %d is not part of this tournament", classID, houseID)})
+			continue
+		}
+		classHouses[classID] = houseID
+	}
+
+	students := map[string]*oneRosterStudent{}
+	var order []*oneRosterStudent
+	for _, user := range users {
+		if !user.active() || !strings.EqualFold(user.fields["role"], "student") {
+			continue
+		}
+		sourcedID := user.fields["sourcedid"]
+		name := strings.TrimSpace(user.fields["givenname"] + " " + user.fields["familyname"])
+		switch {
+		case sourcedID == "":
+			problems = append(problems, importError{File: "users.csv", Line: user.line, Column: "sourcedId", Message: "sourcedId is required"})
+		case students[sourcedID] != nil:
+			problems = append(problems, importError{File: "users.csv", Line: user.line, Column: "sourcedId", Message: fmt.Sprintf("sourcedId %q already used on line %d", sourcedID, students[sourcedID].Line)})
+		case name == "":
+			problems = append(problems, importError{File: "users.csv", Line: user.line, Column: "givenName", Message: "givenName or familyName is required"})
+		default:
+			student := &oneRosterStudent{Line: user.line, Sourced_ID: sourcedID, Student_Name: name}
+			students[sourcedID] = student
+			order = append(order, student)
+		}
+	}
+
+	for _, enrollment := range enrollments {
+		if !enrollment.active() || !strings.EqualFold(enrollment.fields["role"], "student") {
+			continue
+		}
+		student := students[enrollment.fields["usersourcedid"]]
+		houseID, mapped := classHouses[enrollment.fields["classsourcedid"]]
+		if student == nil || !mapped {
+			continue
+		}
+		if student.House_ID != nil && *student.House_ID != houseID {
+			problems = append(problems, importError{File: "enrollments.csv", Line: enrollment.line, Message: fmt.Sprintf("student %q is enrolled in classes of houses %d and %d", student.Sourced_ID, *student.House_ID, houseID)})
+			continue
+		}
+		student.House_ID = &houseID
+	}
+
+	if len(problems) > 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": "importOneRoster: bundle has errors, nothing was imported", "dry_run": dryRun, "errors": problems})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importOneRoster: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	sort.SliceStable(order, func(i, j int) bool { return order[i].Line < order[j].Line })
+	summary := map[string]int{oneRosterCreated: 0, oneRosterUpdated: 0, oneRosterUnchanged: 0, oneRosterSkipped: 0}
+	for _, student := range order {
+		if err := importOneRosterStudent(tx, parsedID, student); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importOneRoster: users.csv line %d: %v", student.Line, err)})
+			return
+		}
+		summary[student.Action]++
+	}
+
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("importOneRoster: %v", err)})
+			return
+		}
+	}
+
+	if order == nil {
+		order = []*oneRosterStudent{}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"dry_run": dryRun, "summary": summary, "students": order})
+}
+
+// importOneRosterStudent creates or updates one student within tx and records the outcome on it.
+// A student who already has a house in the tournament keeps it; moving them goes through TransferStudentById.
+// Deleted students are left as they are, and so are users matching several students by name.
+func importOneRosterStudent(tx *sql.Tx, tournamentID int64, student *oneRosterStudent) error {
+	existing, matches, err := findOneRosterStudent(tx, tournamentID, student.Sourced_ID, student.Student_Name)
+	if err != nil {
+		return err
+	}
+	if len(matches.inScope) > 1 {
+		ids := make([]int64, len(matches.inScope))
+		for i, match := range matches.inScope {
+			ids[i] = match.ID
+		}
+		student.Action = oneRosterSkipped
+		student.House_ID = nil
+		student.Warnings = append(student.Warnings, fmt.Sprintf("not imported, the name matches students %s; delete or rename the duplicates first", joinIDs(ids)))
+		return nil
+	}
+	if len(matches.outOfScope) > 0 {
+		student.Warnings = append(student.Warnings, fmt.Sprintf("students %s of the same name are in other tournaments and were not adopted", joinIDs(matches.outOfScope)))
+	}
+
+	if existing == nil {
+		sourcedID := student.Sourced_ID
+		student.Student_ID, err = insertStudent(tx, models.Student{Student_Name: student.Student_Name, House_ID: student.House_ID, External_ID: &sourcedID})
+		student.Action = oneRosterCreated
+		return err
+	}
+
+	student.Student_ID = existing.ID
+	student.Action = oneRosterUnchanged
+	if existing.Deleted_At != nil {
+		student.Warnings = append(student.Warnings, "not updated, the student is deleted; restore them first")
+		student.House_ID = nil
+		return nil
+	}
+	if existing.External_ID == nil || existing.Student_Name != student.Student_Name {
+		_, err = tx.Exec("UPDATE Students SET Student_Name = ?, External_ID = ?, Version = Version + 1 WHERE ID = ?", student.Student_Name, student.Sourced_ID, existing.ID)
+		if err != nil {
+			return err
+		}
+		student.Action = oneRosterUpdated
+	}
+
+	if student.House_ID == nil {
+		return nil
+	}
+	enrolled, err := enrollInHouse(tx, existing.ID, *student.House_ID)
+	switch {
+	case errors.Is(err, errUseTransfer):
+		student.Warnings = append(student.Warnings, fmt.Sprintf("not enrolled in house %d, already in another house of this tournament; use a transfer to move them", *student.House_ID))
+		student.House_ID = nil
+	case err != nil:
+		return err
+	case enrolled:
+		student.Action = oneRosterUpdated
+	}
+	return nil
+}
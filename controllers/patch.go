@@ -0,0 +1,133 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for partially updating resources in the house-cup application.
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// patchField describes a column that may be set through a JSON Merge Patch document.
+type patchField struct {
+	column   string
+	nullable bool
+	decode   func(json.RawMessage) (interface{}, error)
+}
+
+// stringField decodes a JSON string member.
+func stringField(raw json.RawMessage) (interface{}, error) {
+	var value string
+	err := json.Unmarshal(raw, &value)
+	return value, err
+}
+
+// intField decodes a JSON integer member.
+func intField(raw json.RawMessage) (interface{}, error) {
+	var value int64
+	err := json.Unmarshal(raw, &value)
+	return value, err
+}
+
+// Fields accepted by the PATCH handlers, keyed by their JSON member names.
+var (
+	tournamentPatchFields = map[string]patchField{
+		"tournament_name": {column: "Tournament_Name", decode: stringField},
+		"created_at":      {column: "Created_At", decode: stringField},
+		"ended_at":        {column: "Ended_At", nullable: true, decode: stringField},
+	}
+	housePatchFields = map[string]patchField{
+		"house_name": {column: "House_Name", decode: stringField},
+	}
+	studentPatchFields = map[string]patchField{
+		"student_name": {column: "Student_Name", decode: stringField},
+		"house_id":     {column: "House_ID", decode: intField},
+		"external_id":  {column: "External_ID", nullable: true, decode: stringField},
+	}
+)
+
+// patchError reports a merge patch member that cannot be applied.
+type patchError struct {
+	message string
+}
+
+func (e *patchError) Error() string {
+	return e.message
+}
+
+// readMergePatch parses a JSON Merge Patch (RFC 7396) document.
+// The document must be a JSON object; the read-only "id" and "version" members are ignored.
+func readMergePatch(body io.Reader) (map[string]json.RawMessage, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(data, &patch); err != nil || patch == nil {
+		return nil, &patchError{"merge patch must be a JSON object"}
+	}
+	delete(patch, "id")
+	delete(patch, "version")
+	return patch, nil
+}
+
+// applyMergePatch updates the row of table identified by id with the members of patch and bumps its version.
+// Members that are absent are left untouched and a null member clears a nullable column.
+// When ifMatch is set the update only applies to that version of the row.
+// It returns a *patchError for an invalid member, errNotFound or errPreconditionFailed.
+func applyMergePatch(db execQuerier, table string, id int64, patch map[string]json.RawMessage, fields map[string]patchField, ifMatch *int64) error {
+	assignments := []string{"Version = Version + 1"}
+	var args []interface{}
+
+	for name, raw := range patch {
+		field, ok := fields[name]
+		if !ok {
+			return &patchError{fmt.Sprintf("unknown field %q", name)}
+		}
+
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			if !field.nullable {
+				return &patchError{fmt.Sprintf("field %q cannot be null", name)}
+			}
+			assignments = append(assignments, field.column+" = NULL")
+			continue
+		}
+
+		value, err := field.decode(raw)
+		if err != nil {
+			return &patchError{fmt.Sprintf("field %q: %v", name, err)}
+		}
+		assignments = append(assignments, field.column+" = ?")
+		args = append(args, value)
+	}
+
+	// An empty patch changes nothing but still has to address an existing, current row
+	if len(patch) == 0 {
+		return checkVersion(db, table, id, ifMatch)
+	}
+
+	query := "UPDATE " + table + " SET " + strings.Join(assignments, ", ") + " WHERE ID = ?"
+	args = append(args, id)
+	if softDeletable[table] {
+		query += " AND Deleted_At IS NULL"
+	}
+	if ifMatch != nil {
+		query += " AND Version = ?"
+		args = append(args, *ifMatch)
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	// The version bump guarantees a matched row is reported as affected
+	affected, err := result.RowsAffected()
+	if err != nil || affected > 0 {
+		return err
+	}
+	return checkVersion(db, table, id, ifMatch)
+}
@@ -3,13 +3,20 @@
 package controllers
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/events"
+	"github.com/gambinish/house-cup/ledger"
 	"github.com/gambinish/house-cup/models"
+	"github.com/gambinish/house-cup/outbox"
 
 	"github.com/gin-gonic/gin"
 )
@@ -30,7 +37,7 @@ func GetPoints(c *gin.Context) {
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var point models.Point
-		if err := rows.Scan(&point.ID, &point.Points, &point.Notes, &point.Student_ID); err != nil {
+		if err := rows.Scan(&point.ID, &point.Points, &point.Notes, &point.Student_ID, &point.House_ID, &point.Created_At, &point.Kind, &point.Reverses_ID, &point.Raw_Points, &point.Category, &point.Multiplier_IDs); err != nil {
 			log.Print(err)
 			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Errorf("getPoints: %v", err)})
 		}
@@ -65,7 +72,7 @@ func GetPointsByStudentId(c *gin.Context) {
 	for rows.Next() {
 		var point models.Point
 
-		if err := rows.Scan(&point.ID, &point.Points, &point.Notes, &point.Student_ID); err != nil {
+		if err := rows.Scan(&point.ID, &point.Points, &point.Notes, &point.Student_ID, &point.House_ID, &point.Created_At, &point.Kind, &point.Reverses_ID, &point.Raw_Points, &point.Category, &point.Multiplier_IDs); err != nil {
 			log.Print(err)
 			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Errorf("getPoints: %v", err)})
 		}
@@ -105,7 +112,7 @@ func GetPointsByHouseId(c *gin.Context) {
 	for rows.Next() {
 		var point models.Point
 
-		if err := rows.Scan(&point.ID, &point.Points, &point.Notes, &point.Student_ID); err != nil {
+		if err := rows.Scan(&point.ID, &point.Points, &point.Notes, &point.Student_ID, &point.House_ID, &point.Created_At, &point.Kind, &point.Reverses_ID, &point.Raw_Points, &point.Category, &point.Multiplier_IDs); err != nil {
 			log.Print(err)
 			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Errorf("getPoints: %v", err)})
 		}
@@ -132,46 +139,435 @@ func PostPoints(c *gin.Context) {
 		return
 	}
 
+	if _, err := recordAward(db, newPoints); err != nil {
+		log.Print(err)
+		respondWriteError(c, "postPoints", err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"succes": true})
+	return
+}
+
+// PostPointsByStudentId awards points to a specific student.
+// It takes the student ID as a URL parameter, parses the points and notes from the JSON payload,
+// credits the award to the student's house, and returns the created points record in JSON format.
+func PostPointsByStudentId(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("postPoints: %v", err)})
+		return
+	}
+
+	var newPoints models.Point
+	if err := c.BindJSON(&newPoints); err != nil {
+		return
+	}
+	newPoints.Student_ID = &parsedID
+	newPoints.House_ID = 0
+
+	newPoints, err = recordAward(db, newPoints)
+	if err != nil {
+		respondWriteError(c, "postPoints", err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, newPoints)
+}
+
+// recordAward awards points in a transaction of its own, writing the award event to the outbox
+// in the same transaction.
+// When the award names a student but no house, it is credited to the student's current house.
+// A missing or deleted student is reported as errNotFound. It returns the points record with its new ID.
+func recordAward(db *sql.DB, point models.Point) (models.Point, error) {
 	tx, err := db.Begin()
 	if err != nil {
-		log.Print(err)
-		// Handle error
+		return point, err
+	}
+	defer tx.Rollback()
+
+	// Deleted students cannot be awarded points
+	if point.Student_ID != nil {
+		var houseID sql.NullInt64
+		err = tx.QueryRow("SELECT House_ID FROM Students WHERE ID = ? AND Deleted_At IS NULL", *point.Student_ID).Scan(&houseID)
+		if err == sql.ErrNoRows {
+			return point, fmt.Errorf("student %d: %w", *point.Student_ID, errNotFound)
+		}
+		if err != nil {
+			return point, err
+		}
+		if point.House_ID == 0 {
+			if !houseID.Valid {
+				return point, fmt.Errorf("student %d: %w", *point.Student_ID, errNoHouse)
+			}
+			point.House_ID = houseID.Int64
+		}
+	}
+
+	point, err = awardPoints(tx, point)
+	if err != nil {
+		return point, err
+	}
+	granted, err := grantAchievements(tx, []models.Point{point})
+	if err != nil {
+		return point, err
+	}
+	if err := announce(tx, append([]events.Event{{Type: events.Award, House_ID: point.House_ID, Data: point}}, granted...)); err != nil {
+		return point, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return point, err
+	}
+	outbox.Default.Notify()
+	return point, nil
+}
+
+// errUseLedger reports an update that tried to set a points total directly.
+var errUseLedger = errors.New("points totals follow the points ledger, award or reverse points instead")
+
+// rejectTotalChange returns errUseLedger when total differs from the points total held in column
+// by the row of table identified by id. Totals are projections of the ledger and only change through it.
+func rejectTotalChange(q querier, table string, column string, id int64, total int64) error {
+	var current int64
+	err := q.QueryRow("SELECT "+column+" FROM "+table+" WHERE ID = ?", id).Scan(&current)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if current != total {
+		return errUseLedger
+	}
+	return nil
+}
+
+// dropUnchangedTotal removes a points total member from a merge patch when it matches the row of table
+// identified by id, and returns errUseLedger when it would change it.
+func dropUnchangedTotal(q querier, patch map[string]json.RawMessage, member string, table string, column string, id int64) error {
+	raw, ok := patch[member]
+	if !ok {
+		return nil
+	}
+	var total *int64
+	if err := json.Unmarshal(raw, &total); err != nil {
+		return &patchError{fmt.Sprintf("field %q: %v", member, err)}
+	}
+	if total == nil {
+		return &patchError{fmt.Sprintf("field %q cannot be null", member)}
+	}
+	if err := rejectTotalChange(q, table, column, id, *total); err != nil {
+		return err
+	}
+	delete(patch, member)
+	return nil
+}
+
+// awardPoints appends an award to the ledger within tx after applying the multipliers in effect,
+// which brings the totals of the student (when there is one) and the house it is awarded to up to date.
+// It returns the record with its ID, kind, raw and effective amounts.
+func awardPoints(tx *sql.Tx, point models.Point) (models.Point, error) {
+	appended, err := ledger.AppendAwards(tx, point)
+	if err != nil {
+		return point, err
+	}
+	return appended[0], nil
+}
+
+// GetPointById retrieves a specific points record by its ID.
+// It takes the points ID as a URL parameter, queries the database for the corresponding record,
+// and returns the result in JSON format.
+func GetPointById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getPoint: %v", err)})
 		return
 	}
 
-	_, err = tx.Exec(`
-		INSERT INTO Points (Points, Notes, Student_ID, House_ID) VALUES (?, ?, ?, ?)
-	`, newPoints.Points, newPoints.Notes, newPoints.Student_ID, newPoints.House_ID)
+	row := db.QueryRow("SELECT * FROM Points WHERE ID = ?", parsedID)
+	var point models.Point
+	err = row.Scan(&point.ID, &point.Points, &point.Notes, &point.Student_ID, &point.House_ID, &point.Created_At, &point.Kind, &point.Reverses_ID, &point.Raw_Points, &point.Category, &point.Multiplier_IDs)
+	if err == sql.ErrNoRows {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("points record %d not found", parsedID)})
+		return
+	}
 	if err != nil {
-		log.Print(err)
-		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getPoint: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, point)
+}
+
+// DeletePointById reverses a specific points record by its ID.
+// It takes the points ID as a URL parameter and, inside a single transaction, appends a reversal of the record
+// to the ledger, which takes its points off the student and house it was awarded to. The record itself is kept.
+// A record can only be reversed once and reversals cannot be reversed.
+// It responds with a JSON message indicating the success of the reversal and the reversal record.
+func DeletePointById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deletePoint: %v", err)})
 		return
 	}
 
-	// Update the Points row in the Students table by incrementing it
-	_, err = tx.Exec(`UPDATE Students SET Points = Points + ? WHERE ID = ?;`, newPoints.Points, newPoints.Student_ID)
+	tx, err := db.Begin()
 	if err != nil {
-		log.Print(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deletePoint: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	reversal, err := ledger.Reverse(tx, parsedID, fmt.Sprintf("Reversal of points record %d", parsedID))
+	switch {
+	case err == sql.ErrNoRows:
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("points record %d not found", parsedID)})
+		return
+	case errors.Is(err, ledger.ErrAlreadyReversed), errors.Is(err, ledger.ErrIrreversible):
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("deletePoint: %v", err)})
+		return
+	case err != nil:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deletePoint: %v", err)})
+		return
+	}
+
+	if err := announce(tx, []events.Event{{Type: events.Reversal, House_ID: reversal.House_ID, Data: reversal}}); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deletePoint: %v", err)})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deletePoint: %v", err)})
+		return
+	}
+	outbox.Default.Notify()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Points record reversed successfully", "reversal": reversal})
+}
+
+// bulkAwardRequest is the payload of a bulk award. Exactly one of Student_IDs, House_ID or Filter selects the students.
+type bulkAwardRequest struct {
+	Student_IDs    []int64          `json:"student_ids"`
+	House_ID       *int64           `json:"house_id"`
+	Filter         *bulkAwardFilter `json:"filter"`
+	Points         int64            `json:"points" binding:"required"`
+	Notes          string           `json:"notes"`
+	Category       *string          `json:"category"`
+	All_Or_Nothing *bool            `json:"all_or_nothing"`
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, so they match literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// bulkAwardFilter selects students by tournament, house, name and points. With a tournament set it selects the students
+// enrolled in it, by their house and points in that tournament; otherwise by their current house and points.
+type bulkAwardFilter struct {
+	Tournament_ID *int64 `json:"tournament_id"`
+	House_ID      *int64 `json:"house_id"`
+	Name_Contains string `json:"name_contains"`
+	Min_Points    *int64 `json:"min_points"`
+	Max_Points    *int64 `json:"max_points"`
+}
+
+// bulkAwardFailure names a requested student that could not be awarded.
+type bulkAwardFailure struct {
+	Student_ID int64  `json:"student_id"`
+	Error      string `json:"error"`
+}
+
+// PostBulkPoints awards the same points to many students in a single transaction.
+// It parses the JSON payload from the request, resolves the students named by student_ids, house_id or filter,
+// and appends one points record per student to the ledger, which updates their student and house totals.
+// The award is atomic: any requested student that cannot be awarded cancels it and is listed as a failure.
+// Setting all_or_nothing to false awards the others instead. It returns a summary of the awards and failures in JSON format.
+func PostBulkPoints(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	var request bulkAwardRequest
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	selectors := 0
+	if request.Student_IDs != nil {
+		selectors++
+	}
+	if request.House_ID != nil {
+		selectors++
+	}
+	if request.Filter != nil {
+		selectors++
+	}
+	if selectors != 1 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "postBulkPoints: exactly one of student_ids, house_id or filter is required"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postBulkPoints: %v", err)})
+		return
+	}
+
+	students, failures, err := resolveBulkAwardStudents(tx, request)
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postBulkPoints: %v", err)})
+		return
+	}
+	allOrNothing := request.All_Or_Nothing == nil || *request.All_Or_Nothing
+	if len(students) == 0 || (allOrNothing && len(failures) > 0) {
 		tx.Rollback()
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": "postBulkPoints: no points were awarded", "awarded": []models.Point{}, "failures": failures})
 		return
 	}
 
-	// Update the House_Points in the Houses table by incrementing it
-	_, err = tx.Exec(`UPDATE Houses
-					    SET House_Points = House_Points + ?
-						WHERE ID = ?;`, newPoints.Points, newPoints.House_ID)
+	points := make([]models.Point, 0, len(students))
+	for _, student := range students {
+		studentID := student.ID
+		points = append(points, models.Point{Points: request.Points, Notes: request.Notes, Student_ID: &studentID, House_ID: *student.House_ID, Category: request.Category})
+	}
+	awarded, err := ledger.AppendAwards(tx, points...)
 	if err != nil {
-		log.Print(err)
 		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postBulkPoints: %v", err)})
 		return
 	}
 
-	err = tx.Commit()
+	granted, err := grantAchievements(tx, awarded)
 	if err != nil {
-		log.Print(err)
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postBulkPoints: %v", err)})
 		return
 	}
 
-	c.IndentedJSON(http.StatusOK, gin.H{"succes": true})
-	return
+	changes := make([]events.Event, 0, len(awarded)+len(granted))
+	for _, point := range awarded {
+		changes = append(changes, events.Event{Type: events.Award, House_ID: point.House_ID, Data: point})
+	}
+	if err := announce(tx, append(changes, granted...)); err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postBulkPoints: %v", err)})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postBulkPoints: %v", err)})
+		return
+	}
+	outbox.Default.Notify()
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"awarded":       awarded,
+		"failures":      failures,
+		"total_awarded": request.Points * int64(len(awarded)),
+	})
+}
+
+// resolveBulkAwardStudents loads the students selected by a bulk award request within tx.
+// Explicitly requested student IDs that are unknown or repeated are returned as failures.
+func resolveBulkAwardStudents(tx *sql.Tx, request bulkAwardRequest) ([]models.Student, []bulkAwardFailure, error) {
+	failures := []bulkAwardFailure{}
+
+	var query string
+	var args []interface{}
+	switch {
+	case request.Student_IDs != nil:
+		if len(request.Student_IDs) == 0 {
+			return nil, failures, nil
+		}
+		placeholders := make([]string, len(request.Student_IDs))
+		for i, id := range request.Student_IDs {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		query = "SELECT ID, House_ID FROM Students WHERE Deleted_At IS NULL AND ID IN (" + strings.Join(placeholders, ", ") + ")"
+	case request.House_ID != nil:
+		query = "SELECT ID, House_ID FROM Students WHERE Deleted_At IS NULL AND House_ID = ?"
+		args = append(args, *request.House_ID)
+	default:
+		filter := request.Filter
+		// Students enrolled in a tournament are awarded in their house of that tournament, wherever they are now,
+		// and filtered on the points they earned for it
+		house, points := "Students.House_ID", "Students.Points"
+		query = "SELECT Students.ID, Students.House_ID FROM Students WHERE Students.Deleted_At IS NULL"
+		if filter.Tournament_ID != nil {
+			house, points = "Enrollments.House_ID", "COALESCE(Student_House_Points.Points, 0)"
+			query = `SELECT Students.ID, Enrollments.House_ID FROM Students
+						JOIN Enrollments ON Enrollments.Student_ID = Students.ID AND Enrollments.Tournament_ID = ?
+						LEFT JOIN Student_House_Points ON Student_House_Points.Student_ID = Students.ID AND Student_House_Points.House_ID = Enrollments.House_ID
+						WHERE Students.Deleted_At IS NULL`
+			args = append(args, *filter.Tournament_ID)
+		} else {
+			query += " AND Students.House_ID IS NOT NULL"
+		}
+		if filter.House_ID != nil {
+			query += " AND " + house + " = ?"
+			args = append(args, *filter.House_ID)
+		}
+		if filter.Name_Contains != "" {
+			query += " AND Students.Student_Name LIKE ?"
+			args = append(args, "%"+likeEscaper.Replace(filter.Name_Contains)+"%")
+		}
+		if filter.Min_Points != nil {
+			query += " AND " + points + " >= ?"
+			args = append(args, *filter.Min_Points)
+		}
+		if filter.Max_Points != nil {
+			query += " AND " + points + " <= ?"
+			args = append(args, *filter.Max_Points)
+		}
+	}
+
+	rows, err := tx.Query(query+" ORDER BY Students.ID", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	found := map[int64]models.Student{}
+	var students []models.Student
+	for rows.Next() {
+		var student models.Student
+		if err := rows.Scan(&student.ID, &student.House_ID); err != nil {
+			return nil, nil, err
+		}
+		found[student.ID] = student
+		students = append(students, student)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// Keep the caller's order for explicit IDs and report the ones that were not found
+	if request.Student_IDs != nil {
+		students = students[:0]
+		seen := map[int64]bool{}
+		for _, id := range request.Student_IDs {
+			student, ok := found[id]
+			switch {
+			case seen[id]:
+				failures = append(failures, bulkAwardFailure{Student_ID: id, Error: "student listed more than once"})
+			case !ok:
+				failures = append(failures, bulkAwardFailure{Student_ID: id, Error: "student not found"})
+			case student.House_ID == nil:
+				failures = append(failures, bulkAwardFailure{Student_ID: id, Error: "student is not assigned to a house"})
+			default:
+				students = append(students, student)
+			}
+			seen[id] = true
+		}
+	}
+
+	return students, failures, nil
 }
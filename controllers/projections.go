@@ -0,0 +1,66 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for managing the projections of the points ledger in the house-cup application.
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/ledger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetProjections lists the names of the projections built from the points ledger in JSON format.
+func GetProjections(c *gin.Context) {
+	names := make([]string, 0, len(ledger.Projections))
+	for _, projection := range ledger.Projections {
+		names = append(names, projection.Name())
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"projections": names})
+}
+
+// RebuildProjections rebuilds projections of the points ledger from scratch by replaying every points record.
+// It takes the projections to rebuild as repeated name query parameters, all of them by default, and rebuilds
+// them in a single transaction, so readers see either the old or the rebuilt state.
+// It returns the rebuilt projections and how many records were replayed in JSON format.
+func RebuildProjections(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	projections := ledger.Projections
+	if names := c.QueryArray("name"); len(names) > 0 {
+		projections = nil
+		for _, name := range names {
+			projection := ledger.Lookup(name)
+			if projection == nil {
+				c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("rebuildProjections: unknown projection %q", name)})
+				return
+			}
+			projections = append(projections, projection)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("rebuildProjections: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	replayed, err := ledger.Rebuild(tx, projections...)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("rebuildProjections: %v", err)})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("rebuildProjections: %v", err)})
+		return
+	}
+
+	names := make([]string, 0, len(projections))
+	for _, projection := range projections {
+		names = append(names, projection.Name())
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"rebuilt": names, "replayed": replayed})
+}
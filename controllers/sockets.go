@@ -0,0 +1,281 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for the WebSocket channel of interactive awarding clients in the house-cup application.
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gambinish/house-cup/audit"
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/events"
+	"github.com/gambinish/house-cup/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Timing of the WebSocket keep-alive: the server pings every socketPingInterval and drops
+// connections that stay silent for socketPongWait.
+const (
+	socketPingInterval = 30 * time.Second
+	socketPongWait     = 60 * time.Second
+	socketWriteWait    = 10 * time.Second
+	socketQueueSize    = 64
+)
+
+// Message types of the WebSocket protocol.
+const (
+	socketSubscribe   = "subscribe"
+	socketUnsubscribe = "unsubscribe"
+	socketAward       = "award"
+	socketAck         = "ack"
+	socketEvent       = "event"
+	socketDropped     = "dropped"
+)
+
+// socketRequest is a message sent by a client. ID is echoed in the acknowledgement.
+type socketRequest struct {
+	Type          string `json:"type"`
+	ID            string `json:"id"`
+	Tournament_ID int64  `json:"tournament_id"`
+	House_ID      int64  `json:"house_id"`
+	Student_ID    *int64 `json:"student_id"`
+	Points        *int64 `json:"points"`
+	Notes         string `json:"notes"`
+	Last_Event_ID uint64 `json:"last_event_id"`
+}
+
+// socketReply is a message sent to a client: an acknowledgement of one of its requests or a published event.
+type socketReply struct {
+	Type  string        `json:"type"`
+	ID    string        `json:"id,omitempty"`
+	OK    bool          `json:"ok"`
+	Error string        `json:"error,omitempty"`
+	Data  interface{}   `json:"data,omitempty"`
+	Event *events.Event `json:"event,omitempty"`
+}
+
+// socketUpgrader accepts same-origin clients and the origins listed in WS_ALLOWED_ORIGINS.
+var socketUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		parsed, err := url.Parse(origin)
+		if err == nil && strings.EqualFold(parsed.Host, r.Host) {
+			return true
+		}
+		for _, allowed := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+			if allowed = strings.TrimSpace(allowed); allowed != "" && (allowed == "*" || strings.EqualFold(allowed, origin)) {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// socketSession is one connected client. All writes go through out so only the writer touches the connection.
+type socketSession struct {
+	conn *websocket.Conn
+	out  chan socketReply
+	done chan struct{}
+
+	mu  sync.Mutex
+	sub *events.Subscription
+}
+
+// send queues a reply unless the session has ended.
+func (s *socketSession) send(reply socketReply) {
+	select {
+	case s.out <- reply:
+	case <-s.done:
+	}
+}
+
+// subscribe replaces the session's subscription and forwards its events until it is closed.
+func (s *socketSession) subscribe(filter events.Filter, lastEventID uint64) (*events.Subscription, []events.Event, bool) {
+	sub, missed, complete := events.Default.Subscribe(filter, lastEventID)
+
+	s.mu.Lock()
+	previous := s.sub
+	s.sub = sub
+	s.mu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+
+	go func() {
+		for event := range sub.Events {
+			event := event
+			s.send(socketReply{Type: socketEvent, OK: true, Event: &event})
+		}
+		s.mu.Lock()
+		// A replaced subscription must not clear its successor
+		dropped := s.sub == sub
+		if dropped {
+			s.sub = nil
+		}
+		s.mu.Unlock()
+		if dropped {
+			// The hub gave up on this client for falling behind
+			s.send(socketReply{Type: socketDropped, Error: "subscription dropped for falling behind, subscribe again with last_event_id"})
+		}
+	}()
+	return sub, missed, complete
+}
+
+// unsubscribe closes the session's subscription, if any.
+func (s *socketSession) unsubscribe() {
+	s.mu.Lock()
+	sub := s.sub
+	s.sub = nil
+	s.mu.Unlock()
+	if sub != nil {
+		sub.Close()
+	}
+}
+
+// writeLoop writes queued replies and keep-alive pings until the session ends.
+func (s *socketSession) writeLoop() {
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case reply := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := s.conn.WriteJSON(reply); err != nil {
+				s.conn.Close()
+				return
+			}
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait)); err != nil {
+				s.conn.Close()
+				return
+			}
+		case <-s.done:
+			s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(socketWriteWait))
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// ServeSocket upgrades the request to a WebSocket for interactive clients.
+// Clients send JSON messages with a type and an id that is echoed in the acknowledgement:
+// "subscribe" with a tournament_id and/or house_id (and optionally last_event_id to resume) replaces the
+// connection's subscription, "unsubscribe" ends it, and "award" with points, notes and a student_id and/or
+// house_id awards points through the same path as PostPoints. Published award, reversal, transfer and
+// house_total events matching the subscription are pushed as "event" messages.
+func ServeSocket(c *gin.Context) {
+	conn, err := socketUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already answered the request
+		log.Print("serveSocket: ", err)
+		return
+	}
+
+	session := &socketSession{conn: conn, out: make(chan socketReply, socketQueueSize), done: make(chan struct{})}
+	go session.writeLoop()
+	defer func() {
+		session.unsubscribe()
+		close(session.done)
+	}()
+
+	conn.SetReadLimit(64 * 1024)
+	conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(socketPongWait))
+
+		var request socketRequest
+		if err := json.Unmarshal(message, &request); err != nil {
+			session.send(socketReply{Type: socketAck, Error: fmt.Sprintf("invalid message: %v", err)})
+			continue
+		}
+		reply := socketReply{Type: socketAck, ID: request.ID}
+
+		switch request.Type {
+		case socketSubscribe:
+			if request.Tournament_ID == 0 && request.House_ID == 0 {
+				reply.Error = "subscribe needs a tournament_id or house_id"
+				break
+			}
+			sub, missed, complete := session.subscribe(events.Filter{Tournament_ID: request.Tournament_ID, House_ID: request.House_ID}, request.Last_Event_ID)
+			reply.OK = true
+			reply.Data = gin.H{"last_event_id": sub.Start, "complete": complete}
+			session.send(reply)
+			for i := range missed {
+				session.send(socketReply{Type: socketEvent, OK: true, Event: &missed[i]})
+			}
+			continue
+		case socketUnsubscribe:
+			session.unsubscribe()
+			reply.OK = true
+		case socketAward:
+			if request.Points == nil || (request.Student_ID == nil && request.House_ID == 0) {
+				reply.Error = "award needs points and a student_id or house_id"
+				break
+			}
+			point, err := recordAward(config.ConnectToDB(), models.Point{Points: *request.Points, Notes: request.Notes, Student_ID: request.Student_ID, House_ID: request.House_ID})
+			auditSocketAward(c, point, err)
+			if err != nil {
+				reply.Error = err.Error()
+				break
+			}
+			reply.OK = true
+			reply.Data = point
+		default:
+			reply.Error = fmt.Sprintf("unknown message type %q", request.Type)
+		}
+		session.send(reply)
+	}
+}
+
+// auditSocketAward records an award made over a WebSocket in the audit log, which the Audit middleware
+// cannot do for messages arriving after the upgrade. Failed awards are recorded with status 422.
+func auditSocketAward(c *gin.Context, point models.Point, awardErr error) {
+	db := config.ConnectToDB()
+	entry := audit.Entry{
+		Request_ID:  c.Writer.Header().Get("X-Request-ID"),
+		Actor:       c.GetHeader("X-Actor"),
+		Action:      "WS award",
+		Method:      "WS",
+		Path:        c.Request.URL.Path,
+		Entity:      "points",
+		Status_Code: http.StatusCreated,
+		Client_IP:   c.ClientIP(),
+	}
+	if entry.Request_ID == "" {
+		entry.Request_ID = audit.NewRequestID()
+	}
+	if awardErr != nil {
+		entry.Status_Code = http.StatusUnprocessableEntity
+	} else {
+		entry.Entity_ID = strconv.FormatInt(point.ID, 10)
+		var err error
+		if entry.After, err = audit.Snapshot(db, "Points", "ID", point.ID); err != nil {
+			log.Print("serveSocket: ", err)
+		}
+	}
+	if err := audit.Write(db, entry); err != nil {
+		log.Print("serveSocket: ", err)
+	}
+}
@@ -0,0 +1,187 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for streaming live leaderboard updates of the house-cup application.
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/events"
+	"github.com/gambinish/house-cup/outbox"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamHeartbeat is how often an idle stream sends a comment to keep proxies from closing it.
+const streamHeartbeat = 15 * time.Second
+
+// houseTotal is the data of a house_total event.
+type houseTotal struct {
+	House_ID     int64  `json:"house_id"`
+	House_Name   string `json:"house_name"`
+	House_Points int64  `json:"house_points"`
+}
+
+// announce writes to the outbox, within tx, the events announcing changes to the points of some houses.
+// Each change needs its Type, House_ID and Data; the tournament of its house is filled in and one
+// house_total event is added for every house involved, including the extra houses given.
+// Notify the outbox relay once the transaction has committed.
+func announce(tx *sql.Tx, changes []events.Event, houseIDs ...int64) error {
+	var order []int64
+	seen := map[int64]bool{}
+	for _, houseID := range houseIDs {
+		if !seen[houseID] {
+			seen[houseID] = true
+			order = append(order, houseID)
+		}
+	}
+	for _, change := range changes {
+		if !seen[change.House_ID] {
+			seen[change.House_ID] = true
+			order = append(order, change.House_ID)
+		}
+	}
+
+	tournaments := map[int64]int64{}
+	var totals []events.Event
+	for _, houseID := range order {
+		var total houseTotal
+		var tournamentID sql.NullInt64
+		err := tx.QueryRow("SELECT ID, House_Name, House_Points, Tournament_ID FROM Houses WHERE ID = ?", houseID).Scan(&total.House_ID, &total.House_Name, &total.House_Points, &tournamentID)
+		if err != nil {
+			return err
+		}
+		tournaments[houseID] = tournamentID.Int64
+		totals = append(totals, events.Event{Type: events.HouseTotal, Tournament_ID: tournamentID.Int64, House_ID: houseID, Data: total})
+	}
+
+	result := make([]events.Event, 0, len(changes)+len(totals))
+	for _, change := range changes {
+		change.Tournament_ID = tournaments[change.House_ID]
+		result = append(result, change)
+	}
+	return outbox.Write(tx, append(result, totals...)...)
+}
+
+// writeEvent writes one Server-Sent Event. An id of zero is left out.
+func writeEvent(w io.Writer, id uint64, name string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload)
+	return err
+}
+
+// StreamTournamentById streams the live leaderboard of a tournament as Server-Sent Events.
+// It takes the tournament ID as a URL parameter. A new stream starts with a snapshot event holding every
+// house total and then receives award, reversal, transfer and house_total events as soon as their changes
+// commit. Clients reconnecting with a Last-Event-ID header (or last_event_id query parameter) get the events
+// they missed instead; if those are no longer available they get a fresh snapshot. Idle streams send a heartbeat
+// comment every 15 seconds. Subscribers share an in-process hub, so an open stream holds no database connection.
+func StreamTournamentById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("streamTournament: %v", err)})
+		return
+	}
+
+	var lastEventID uint64
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("last_event_id")
+	}
+	if value != "" {
+		lastEventID, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("streamTournament: invalid Last-Event-ID %q", value)})
+			return
+		}
+	}
+
+	if err := checkVersion(db, "Tournaments", parsedID, nil); err != nil {
+		respondWriteError(c, "streamTournament", err)
+		return
+	}
+
+	sub, missed, complete := events.Default.Subscribe(events.Filter{Tournament_ID: parsedID}, lastEventID)
+	defer sub.Close()
+
+	// The snapshot is read after subscribing so no change can fall between the two
+	var snapshot []houseTotal
+	if lastEventID == 0 || !complete {
+		rows, err := db.Query("SELECT ID, House_Name, House_Points FROM Houses WHERE Tournament_ID = ? ORDER BY ID", parsedID)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("streamTournament: %v", err)})
+			return
+		}
+		snapshot = []houseTotal{}
+		for rows.Next() {
+			var total houseTotal
+			if err := rows.Scan(&total.House_ID, &total.House_Name, &total.House_Points); err != nil {
+				rows.Close()
+				c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("streamTournament: %v", err)})
+				return
+			}
+			snapshot = append(snapshot, total)
+		}
+		rows.Close()
+		missed = nil
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	fmt.Fprint(c.Writer, "retry: 3000\n\n")
+	if snapshot != nil {
+		err = writeEvent(c.Writer, sub.Start, "snapshot", gin.H{"tournament_id": parsedID, "houses": snapshot})
+	}
+	for _, event := range missed {
+		if err == nil {
+			err = writeEvent(c.Writer, event.ID, event.Type, event)
+		}
+	}
+	if err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				// Dropped for falling behind; the client resumes from its last event ID
+				return
+			}
+			if err := writeEvent(c.Writer, event.ID, event.Type, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
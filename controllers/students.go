@@ -3,24 +3,36 @@
 package controllers
 
 import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 
 	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/events"
+	"github.com/gambinish/house-cup/ledger"
 	"github.com/gambinish/house-cup/models"
+	"github.com/gambinish/house-cup/outbox"
 
 	"github.com/gin-gonic/gin"
 )
 
 // GetStudents retrieves a list of all students.
 // It queries the database for all students and returns the results in JSON format.
+// Deleted students are left out unless the include_deleted query parameter is true.
 func GetStudents(c *gin.Context) {
 	db := config.ConnectToDB()
 	// An albums slice to hold data from returned rows.
 	var students []models.Student
 
-	rows, err := db.Query("SELECT * FROM Students")
+	query := "SELECT * FROM Students WHERE Deleted_At IS NULL"
+	if c.Query("include_deleted") == "true" {
+		query = "SELECT * FROM Students"
+	}
+	rows, err := db.Query(query)
 
 	if err != nil {
 		panic(err)
@@ -28,7 +40,7 @@ func GetStudents(c *gin.Context) {
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var student models.Student
-		if err := rows.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID); err != nil {
+		if err := rows.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID, &student.Deleted_At, &student.Deletion_Policy); err != nil {
 			panic(err)
 		}
 		students = append(students, student)
@@ -41,7 +53,8 @@ func GetStudents(c *gin.Context) {
 
 // GetStudentById retrieves a specific student by their ID.
 // It takes the student ID as a URL parameter, queries the database for the corresponding student,
-// and returns the result in JSON format.
+// and returns the result, with the achievements the student was granted, in JSON format.
+// Deleted students are still found, with their deleted_at set.
 func GetStudentById(c *gin.Context) {
 	db := config.ConnectToDB()
 	id := c.Param("id")
@@ -54,15 +67,36 @@ func GetStudentById(c *gin.Context) {
 	row := db.QueryRow("SELECT * FROM Students WHERE ID = ?", parsedID)
 
 	var student models.Student
-	if err := row.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID); err != nil {
+	if err := row.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID, &student.Deleted_At, &student.Deletion_Policy); err != nil {
 		panic(err)
 	}
-	c.IndentedJSON(http.StatusOK, student)
+
+	granted, err := studentAchievements(db, parsedID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getStudent: %v", err)})
+		return
+	}
+	c.Header("ETag", etag(student.Version))
+	c.IndentedJSON(http.StatusOK, studentProfile{Student: student, Achievements: granted})
+}
+
+// studentProfile is a student with the achievements they were granted.
+type studentProfile struct {
+	models.Student
+	Achievements []models.Achievement `json:"achievements"`
 }
 
-// UpdateStudentById updates a specific student by their ID.
+// studentReplacement is the payload of a full student update; every field must be supplied.
+type studentReplacement struct {
+	Student_Name *string `json:"student_name" binding:"required"`
+	Points       *int64  `json:"points" binding:"required"`
+	House_ID     *int64  `json:"house_id" binding:"required"`
+}
+
+// UpdateStudentById replaces a specific student by their ID.
 // It takes the student ID as a URL parameter, parses the JSON payload from the request,
-// updates the corresponding student in the database, and returns the updated student in JSON format.
+// rejects it if a required field is missing, updates the corresponding student in the database,
+// and returns the updated student in JSON format. Points follow the points ledger and must be left as they are.
 func UpdateStudentById(c *gin.Context) {
 	db := config.ConnectToDB()
 	id := c.Param("id")
@@ -73,31 +107,146 @@ func UpdateStudentById(c *gin.Context) {
 		panic(err)
 	}
 
-	var newStudent models.Student
+	var newStudent studentReplacement
 
 	if err := c.BindJSON(&newStudent); err != nil {
-		panic(err)
+		return
 	}
-	rows, err := db.Query("UPDATE Students SET student_name = ?, points = ?, house_id = ? WHERE id = ?", newStudent.Student_Name, newStudent.Points, newStudent.House_ID, parsedID)
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("updateStudent: %v", err)})
+		return
+	}
+
+	// Moving a student between houses must go through TransferStudentById to keep house totals right
+	if err := rejectHouseChange(db, parsedID, *newStudent.House_ID); err != nil {
+		respondWriteError(c, "updateStudent", err)
+		return
+	}
+
+	// The student's points follow the ledger and are only checked, never written
+	if err := rejectTotalChange(db, "Students", "Points", parsedID, *newStudent.Points); err != nil {
+		respondWriteError(c, "updateStudent", err)
+		return
+	}
+
+	query := "UPDATE Students SET student_name = ?, house_id = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL"
+	args := []interface{}{newStudent.Student_Name, newStudent.House_ID, parsedID}
+	if ifMatch != nil {
+		query += " AND version = ?"
+		args = append(args, *ifMatch)
+	}
+
+	result, err := db.Exec(query, args...)
 
 	if err != nil {
 		panic(err)
 	}
 
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = checkVersion(db, "Students", parsedID, ifMatch)
+		}
+		respondWriteError(c, "updateStudent", err)
+		return
+	}
+
+	if err := ensureEnrolled(db, parsedID, *newStudent.House_ID); err != nil {
+		panic(err)
+	}
+	// A student given their first house is totalled for its tournament
+	if err := ledger.RefreshStudentTotals(db, parsedID); err != nil {
+		panic(err)
+	}
+
 	row := db.QueryRow("SELECT * FROM Students where id = ?", parsedID)
 	var updatedStudent models.Student
-	if err := row.Scan(&updatedStudent.ID, &updatedStudent.Student_Name, &updatedStudent.Points, &updatedStudent.House_ID); err != nil {
+	if err := row.Scan(&updatedStudent.ID, &updatedStudent.Student_Name, &updatedStudent.Points, &updatedStudent.House_ID, &updatedStudent.Version, &updatedStudent.External_ID, &updatedStudent.Deleted_At, &updatedStudent.Deletion_Policy); err != nil {
 		panic(err)
 	}
-	defer rows.Close()
 
 	log.Print(updatedStudent)
+	c.Header("ETag", etag(updatedStudent.Version))
 	c.IndentedJSON(http.StatusOK, updatedStudent)
 }
 
-// GetStudentsByHouseId retrieves a list of students belonging to a specific house.
-// It takes the house ID as a URL parameter, queries the database for the corresponding students,
-// and returns the results in JSON format.
+// PatchStudentById partially updates a specific student by their ID.
+// It takes the student ID as a URL parameter, applies the JSON Merge Patch payload from the request
+// so that only the supplied fields change, and returns the updated student in JSON format.
+// Points follow the points ledger and may only be supplied unchanged.
+func PatchStudentById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchStudent: %v", err)})
+		return
+	}
+
+	patch, err := readMergePatch(c.Request.Body)
+	if err != nil {
+		respondWriteError(c, "patchStudent", err)
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchStudent: %v", err)})
+		return
+	}
+
+	// Moving a student between houses must go through TransferStudentById to keep house totals right
+	var houseID *int64
+	if raw, ok := patch["house_id"]; ok {
+		houseID = new(int64)
+		if err := json.Unmarshal(raw, houseID); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchStudent: field \"house_id\": %v", err)})
+			return
+		}
+		if err := rejectHouseChange(db, parsedID, *houseID); err != nil {
+			respondWriteError(c, "patchStudent", err)
+			return
+		}
+	}
+
+	if err := dropUnchangedTotal(db, patch, "points", "Students", "Points", parsedID); err != nil {
+		respondWriteError(c, "patchStudent", err)
+		return
+	}
+
+	if err := applyMergePatch(db, "Students", parsedID, patch, studentPatchFields, ifMatch); err != nil {
+		respondWriteError(c, "patchStudent", err)
+		return
+	}
+
+	if houseID != nil {
+		err := ensureEnrolled(db, parsedID, *houseID)
+		if err == nil {
+			// A student given their first house is totalled for its tournament
+			err = ledger.RefreshStudentTotals(db, parsedID)
+		}
+		if err != nil {
+			respondWriteError(c, "patchStudent", err)
+			return
+		}
+	}
+
+	row := db.QueryRow("SELECT * FROM Students where id = ?", parsedID)
+	var updatedStudent models.Student
+	if err := row.Scan(&updatedStudent.ID, &updatedStudent.Student_Name, &updatedStudent.Points, &updatedStudent.House_ID, &updatedStudent.Version, &updatedStudent.External_ID, &updatedStudent.Deleted_At, &updatedStudent.Deletion_Policy); err != nil {
+		panic(err)
+	}
+
+	c.Header("ETag", etag(updatedStudent.Version))
+	c.IndentedJSON(http.StatusOK, updatedStudent)
+}
+
+// GetStudentsByHouseId retrieves a list of students enrolled in a specific house.
+// It takes the house ID as a URL parameter, queries the database for the students whose enrollment
+// in the house's tournament is with that house, and returns the results in JSON format.
+// Each student's points are the points they earned in that tournament. Deleted students are left out.
 func GetStudentsByHouseId(c *gin.Context) {
 	db := config.ConnectToDB()
 	id := c.Param("id")
@@ -109,7 +258,13 @@ func GetStudentsByHouseId(c *gin.Context) {
 	// An albums slice to hold data from returned rows.
 	var students []models.Student
 
-	rows, err := db.Query("SELECT * FROM Students WHERE House_ID = ?", parsedID)
+	rows, err := db.Query(`SELECT Students.ID, Students.Student_Name, COALESCE(SUM(Student_House_Points.Points), 0), Enrollments.House_ID, Students.Version, Students.External_ID
+							FROM Enrollments
+							JOIN Students ON Students.ID = Enrollments.Student_ID
+							JOIN Houses ON Houses.Tournament_ID = Enrollments.Tournament_ID
+							LEFT JOIN Student_House_Points ON Student_House_Points.House_ID = Houses.ID AND Student_House_Points.Student_ID = Students.ID
+							WHERE Enrollments.House_ID = ? AND Students.Deleted_At IS NULL
+							GROUP BY Students.ID, Students.Student_Name, Enrollments.House_ID, Students.Version, Students.External_ID`, parsedID)
 
 	if err != nil {
 		panic(err)
@@ -118,7 +273,7 @@ func GetStudentsByHouseId(c *gin.Context) {
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var student models.Student
-		if err := rows.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID); err != nil {
+		if err := rows.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID); err != nil {
 			panic(err)
 		}
 		students = append(students, student)
@@ -129,9 +284,10 @@ func GetStudentsByHouseId(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, students)
 }
 
-// GetStudentsByTournamentId retrieves a list of students associated with a specific tournament.
-// It takes the tournament ID as a URL parameter, queries the database for students in houses
-// associated with the tournament, and returns the results in JSON format.
+// GetStudentsByTournamentId retrieves a list of students enrolled in a specific tournament.
+// It takes the tournament ID as a URL parameter, queries the database for the tournament's enrollments,
+// and returns the results in JSON format. Each student is listed with their house in that tournament
+// and the points they earned in it. Deleted students are left out.
 func GetStudentsByTournamentId(c *gin.Context) {
 	db := config.ConnectToDB()
 	id := c.Param("id")
@@ -143,10 +299,13 @@ func GetStudentsByTournamentId(c *gin.Context) {
 	// An albums slice to hold data from returned rows.
 	var students []models.Student
 
-	rows, err := db.Query(`SELECT Students.*
-							FROM Students
-							JOIN Houses ON Students.House_ID = Houses.ID
-							WHERE Houses.Tournament_ID = ?`, parsedID)
+	rows, err := db.Query(`SELECT Students.ID, Students.Student_Name, COALESCE(SUM(Student_House_Points.Points), 0), Enrollments.House_ID, Students.Version, Students.External_ID
+							FROM Enrollments
+							JOIN Students ON Students.ID = Enrollments.Student_ID
+							JOIN Houses ON Houses.Tournament_ID = Enrollments.Tournament_ID
+							LEFT JOIN Student_House_Points ON Student_House_Points.House_ID = Houses.ID AND Student_House_Points.Student_ID = Students.ID
+							WHERE Enrollments.Tournament_ID = ? AND Students.Deleted_At IS NULL
+							GROUP BY Students.ID, Students.Student_Name, Enrollments.House_ID, Students.Version, Students.External_ID`, parsedID)
 
 	if err != nil {
 		panic(err)
@@ -155,7 +314,7 @@ func GetStudentsByTournamentId(c *gin.Context) {
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var student models.Student
-		if err := rows.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID); err != nil {
+		if err := rows.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID); err != nil {
 			panic(err)
 		}
 		students = append(students, student)
@@ -168,6 +327,7 @@ func GetStudentsByTournamentId(c *gin.Context) {
 
 // PostStudent creates a new student record.
 // It parses the JSON payload from the request, inserts a new student record into the database,
+// enrolls the student in the tournament of their house if they have one,
 // and returns the created student in JSON format.
 func PostStudent(c *gin.Context) {
 	db := config.ConnectToDB()
@@ -178,19 +338,79 @@ func PostStudent(c *gin.Context) {
 		panic(err)
 	}
 
-	rows, err := db.Query("INSERT INTO Students (student_name, points, house_id) VALUES (?, 0, ?)", newStudent.Student_Name, newStudent.House_ID)
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
 
+	newStudent.ID, err = insertStudent(tx, newStudent)
 	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+
+	if err := tx.Commit(); err != nil {
 		panic(err)
 	}
-	defer rows.Close()
 
 	c.IndentedJSON(http.StatusOK, newStudent)
 }
 
+// PostStudentByHouseId creates a new student record in a specific house.
+// It takes the house ID as a URL parameter, parses the JSON payload from the request,
+// inserts a new student record into the database, and returns the created student in JSON format.
+func PostStudentByHouseId(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("postStudent: %v", err)})
+		return
+	}
+
+	var newStudent models.Student
+	if err := c.BindJSON(&newStudent); err != nil {
+		return
+	}
+	newStudent.House_ID = &parsedID
+	newStudent.Points = 0
+
+	var exists int64
+	err = db.QueryRow("SELECT ID FROM Houses WHERE ID = ?", parsedID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("house %d not found", parsedID)})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postStudent: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postStudent: %v", err)})
+		return
+	}
+
+	newStudent.ID, err = insertStudent(tx, newStudent)
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postStudent: %v", err)})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postStudent: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, newStudent)
+}
+
 // PostStudents creates multiple new student records in a single transaction.
 // It parses the JSON payload from the request, starts a transaction, iterates over the array of students,
-// executes the INSERT statement for each one, and commits the transaction if all INSERTs are successful.
+// inserts and enrolls each one, and commits the transaction if all INSERTs are successful.
 // Returns the created students in JSON format.
 func PostStudents(c *gin.Context) {
 	db := config.ConnectToDB()
@@ -207,9 +427,9 @@ func PostStudents(c *gin.Context) {
 		panic(err)
 	}
 
-	// Iterate over the array of students and execute the INSERT statement for each one
-	for _, student := range newStudents {
-		_, err := tx.Exec("INSERT INTO Students (student_name, points, house_id) VALUES (?, 0, ?)", student.Student_Name, student.House_ID)
+	// Iterate over the array of students and insert each one
+	for i, student := range newStudents {
+		newStudents[i].ID, err = insertStudent(tx, student)
 
 		if err != nil {
 			// Rollback the transaction in case of an error
@@ -227,65 +447,321 @@ func PostStudents(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, newStudents)
 }
 
-// DeleteStudentById deletes a student and associated points by their ID.
-// It retrieves the student ID from the request parameter, starts a database transaction,
-// deletes the points associated with the student, queries for the house ID and points associated with the student,
-// deletes the student record, updates House_Points by subtracting the student's points, and commits the transaction
-// if all operations are successful. It responds with a JSON message indicating the success of the deletion.
+// Deletion policies decide what happens to the points a deleted student earned for their houses.
+// The student's own Points rows are kept either way, so their history survives the deletion.
+const (
+	// DeletePolicyKeep leaves the points with the houses.
+	DeletePolicyKeep = "keep"
+	// DeletePolicyRemove takes the points away from the houses with a house-only adjustment per house,
+	// which a restore reverses.
+	DeletePolicyRemove = "remove"
+)
+
+// deletePolicy returns the deletion policy of a request: the policy query parameter,
+// else the STUDENT_DELETE_POLICY environment variable, else DeletePolicyKeep.
+func deletePolicy(c *gin.Context) (string, error) {
+	policy := c.Query("policy")
+	if policy == "" {
+		policy = os.Getenv("STUDENT_DELETE_POLICY")
+	}
+	switch policy {
+	case "":
+		return DeletePolicyKeep, nil
+	case DeletePolicyKeep, DeletePolicyRemove:
+		return policy, nil
+	}
+	return "", fmt.Errorf("policy must be %q or %q", DeletePolicyKeep, DeletePolicyRemove)
+}
+
+// adjustDeletedStudentPoints gives every house the points the student earned for it, times sign,
+// through a house-only adjustment in the ledger, so house totals change while the student's stays untouched.
+// It returns the award events announcing the adjustments.
+func adjustDeletedStudentPoints(tx *sql.Tx, studentID int64, sign int64, notes string) ([]events.Event, error) {
+	rows, err := tx.Query("SELECT House_ID, Points FROM Student_House_Points WHERE Student_ID = ? AND Points <> 0 ORDER BY House_ID", studentID)
+	if err != nil {
+		return nil, err
+	}
+	var adjustments []models.Point
+	for rows.Next() {
+		point := models.Point{Notes: notes, Kind: ledger.Adjustment}
+		if err := rows.Scan(&point.House_ID, &point.Points); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		point.Points *= sign
+		adjustments = append(adjustments, point)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	adjustments, err = ledger.Append(tx, adjustments...)
+	if err != nil {
+		return nil, err
+	}
+	var changes []events.Event
+	for _, point := range adjustments {
+		changes = append(changes, events.Event{Type: events.Award, House_ID: point.House_ID, Data: point})
+	}
+	return changes, nil
+}
+
+// DeleteStudentById soft deletes a student by their ID.
+// It retrieves the student ID from the request parameter and the deletion policy from the policy query parameter
+// (keep or remove, STUDENT_DELETE_POLICY by default). Within a transaction it marks the student deleted, which hides
+// them from listings and blocks further writes, and under the remove policy takes their points away from their houses.
+// Their Points rows, enrollments and transfers are kept for the record and for RestoreStudentById.
+// A student_deleted event holding the deleted student is written to the outbox in the same transaction.
+// It responds with a JSON message indicating the success of the deletion.
 func DeleteStudentById(c *gin.Context) {
 	// Connect to the database
 	db := config.ConnectToDB()
 
 	// Get student ID from the request parameter
-	studentID := c.Param("id")
+	studentID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteStudent: %v", err)})
+		return
+	}
+
+	policy, err := deletePolicy(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteStudent: %v", err)})
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteStudent: %v", err)})
+		return
+	}
 
 	// Start a transaction
 	tx, err := db.Begin()
 	if err != nil {
-		panic(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteStudent: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	// Make sure the student exists, is not deleted yet and is unchanged before touching any totals
+	if err := checkVersion(tx, "Students", studentID, ifMatch); err != nil {
+		respondWriteError(c, "deleteStudent", err)
+		return
 	}
 
-	// Delete points associated with the student
-	_, err = tx.Exec("DELETE FROM Points WHERE Student_ID = ?", studentID)
+	_, err = tx.Exec("UPDATE Students SET Deleted_At = CURRENT_TIMESTAMP, Deletion_Policy = ?, Version = Version + 1 WHERE ID = ?", policy, studentID)
 	if err != nil {
-		// Rollback the transaction in case of an error
-		tx.Rollback()
-		panic(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteStudent: %v", err)})
+		return
 	}
 
-	// Query for the house ID and points associated with the student
-	var houseID, studentPoints int
-	err = tx.QueryRow("SELECT House_ID, Points FROM Students WHERE ID = ?", studentID).Scan(&houseID, &studentPoints)
+	var changes []events.Event
+	if policy == DeletePolicyRemove {
+		changes, err = adjustDeletedStudentPoints(tx, studentID, -1, fmt.Sprintf("Points of deleted student %d removed", studentID))
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteStudent: %v", err)})
+			return
+		}
+	}
+
+	// Announce the student as deleted, along with any change to house totals
+	var student models.Student
+	err = tx.QueryRow("SELECT * FROM Students WHERE ID = ?", studentID).Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID, &student.Deleted_At, &student.Deletion_Policy)
+	if err == nil {
+		err = outbox.Write(tx, events.Event{Type: events.StudentDeleted, Data: student})
+	}
+	if err == nil && len(changes) > 0 {
+		err = announce(tx, changes)
+	}
 	if err != nil {
-		// Rollback the transaction in case of an error
-		tx.Rollback()
-		panic(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteStudent: %v", err)})
+		return
+	}
+
+	// Commit the transaction if all operations are successful
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteStudent: %v", err)})
+		return
 	}
+	outbox.Default.Notify()
+
+	// Respond with a JSON message indicating success
+	c.JSON(http.StatusOK, gin.H{"message": "Student deleted successfully", "policy": policy})
+}
+
+// RestoreStudentById restores a soft deleted student by their ID.
+// It takes the student ID as a URL parameter and, within a transaction, clears the student's deletion
+// and, if they were deleted under the remove policy, gives their houses back the points they earned for them.
+// It returns the restored student in JSON format, or 409 when the student is not deleted.
+func RestoreStudentById(c *gin.Context) {
+	db := config.ConnectToDB()
 
-	// Delete the student
-	_, err = tx.Exec("DELETE FROM Students WHERE ID = ?", studentID)
+	studentID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
-		// Rollback the transaction in case of an error
-		tx.Rollback()
-		panic(err)
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("restoreStudent: %v", err)})
+		return
 	}
 
-	// Update House_Points by subtracting the studentPoints
-	_, err = tx.Exec("UPDATE Houses SET House_Points = House_Points - ? WHERE ID = ?", studentPoints, houseID)
+	ifMatch, err := ifMatchVersion(c)
 	if err != nil {
-		// Rollback the transaction in case of an error
-		tx.Rollback()
-		panic(err)
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("restoreStudent: %v", err)})
+		return
 	}
 
-	// Commit the transaction if all operations are successful
-	err = tx.Commit()
+	tx, err := db.Begin()
 	if err != nil {
-		log.Print(err)
-		panic(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("restoreStudent: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	var version int64
+	var deletedAt, policy *string
+	err = tx.QueryRow("SELECT Version, Deleted_At, Deletion_Policy FROM Students WHERE ID = ? FOR UPDATE", studentID).Scan(&version, &deletedAt, &policy)
+	switch {
+	case err == sql.ErrNoRows:
+		err = errNotFound
+	case err == nil && ifMatch != nil && *ifMatch != version:
+		err = errPreconditionFailed
+	case err == nil && deletedAt == nil:
+		err = errNotDeleted
+	}
+	if err != nil {
+		respondWriteError(c, "restoreStudent", err)
+		return
 	}
 
-	// Respond with a JSON message indicating success
-	c.JSON(http.StatusOK, gin.H{"message": "Student and associated points deleted successfully"})
-	return
+	_, err = tx.Exec("UPDATE Students SET Deleted_At = NULL, Deletion_Policy = NULL, Version = Version + 1 WHERE ID = ?", studentID)
+	var changes []events.Event
+	if err == nil && policy != nil && *policy == DeletePolicyRemove {
+		changes, err = adjustDeletedStudentPoints(tx, studentID, 1, fmt.Sprintf("Points of restored student %d returned", studentID))
+	}
+	if err == nil && len(changes) > 0 {
+		err = announce(tx, changes)
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("restoreStudent: %v", err)})
+		return
+	}
+
+	var student models.Student
+	err = tx.QueryRow("SELECT * FROM Students WHERE ID = ?", studentID).Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID, &student.Deleted_At, &student.Deletion_Policy)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("restoreStudent: %v", err)})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("restoreStudent: %v", err)})
+		return
+	}
+	outbox.Default.Notify()
+
+	c.Header("ETag", etag(student.Version))
+	c.IndentedJSON(http.StatusOK, student)
+}
+
+// studentUpsert is the payload of an upsert by external ID. Points are never part of it.
+type studentUpsert struct {
+	Student_Name *string `json:"student_name" binding:"required"`
+	House_ID     *int64  `json:"house_id"`
+}
+
+// GetStudentByExternalId retrieves a specific student by the external ID given to them by another system.
+// It takes the external ID as a URL parameter, queries the database for the matching student,
+// and returns the student in JSON format.
+func GetStudentByExternalId(c *gin.Context) {
+	db := config.ConnectToDB()
+	externalID := c.Param("external_id")
+
+	row := db.QueryRow("SELECT * FROM Students WHERE External_ID = ?", externalID)
+
+	var student models.Student
+	err := row.Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID, &student.Deleted_At, &student.Deletion_Policy)
+	if err == sql.ErrNoRows {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("student with external ID %q not found", externalID)})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getStudent: %v", err)})
+		return
+	}
+
+	c.Header("ETag", etag(student.Version))
+	c.IndentedJSON(http.StatusOK, student)
+}
+
+// UpsertStudentByExternalId creates or updates a student keyed by their external ID.
+// It takes the external ID as a URL parameter and the student's name and optional house from the JSON payload.
+// A new student is created with no points; an existing one has their name updated and, if they are not enrolled
+// in the house's tournament yet, is enrolled in the house. Points are left untouched and moving a student to
+// another house of the same tournament still goes through TransferStudentById. A deleted student has to be restored first.
+// It returns the student in JSON format, with status 201 when they were created.
+func UpsertStudentByExternalId(c *gin.Context) {
+	db := config.ConnectToDB()
+	externalID := c.Param("external_id")
+
+	var request studentUpsert
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("upsertStudent: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("upsertStudent: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	status := http.StatusOK
+	var studentID int64
+	var deletedAt *string
+	err = tx.QueryRow("SELECT ID, Deleted_At FROM Students WHERE External_ID = ? FOR UPDATE", externalID).Scan(&studentID, &deletedAt)
+	switch {
+	case err == nil && deletedAt != nil:
+		// A deleted student keeps their external ID, so they are not silently recreated or revived
+		err = errDeleted
+	case err == sql.ErrNoRows:
+		if ifMatch != nil {
+			respondWriteError(c, "upsertStudent", errPreconditionFailed)
+			return
+		}
+		studentID, err = insertStudent(tx, models.Student{Student_Name: *request.Student_Name, House_ID: request.House_ID, External_ID: &externalID})
+		status = http.StatusCreated
+	case err == nil:
+		err = checkVersion(tx, "Students", studentID, ifMatch)
+		if err == nil {
+			_, err = tx.Exec("UPDATE Students SET Student_Name = ?, Version = Version + 1 WHERE ID = ? AND Student_Name <> ?", *request.Student_Name, studentID, *request.Student_Name)
+		}
+		if err == nil && request.House_ID != nil {
+			_, err = enrollInHouse(tx, studentID, *request.House_ID)
+		}
+	}
+	if err != nil {
+		respondWriteError(c, "upsertStudent", err)
+		return
+	}
+
+	var student models.Student
+	err = tx.QueryRow("SELECT * FROM Students WHERE ID = ?", studentID).Scan(&student.ID, &student.Student_Name, &student.Points, &student.House_ID, &student.Version, &student.External_ID, &student.Deleted_At, &student.Deletion_Policy)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("upsertStudent: %v", err)})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWriteError(c, "upsertStudent", err)
+		return
+	}
+
+	c.Header("ETag", etag(student.Version))
+	c.IndentedJSON(status, student)
 }
@@ -3,12 +3,17 @@
 package controllers
 
 import (
+	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/events"
+	"github.com/gambinish/house-cup/ledger"
 	"github.com/gambinish/house-cup/models"
+	"github.com/gambinish/house-cup/outbox"
 
 	"github.com/gin-gonic/gin"
 )
@@ -26,7 +31,7 @@ func GetTournaments(c *gin.Context) {
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var tournament models.Tournament
-		if err := rows.Scan(&tournament.ID, &tournament.Tournament_Name, &tournament.Created_At, &tournament.Ended_At); err != nil {
+		if err := rows.Scan(&tournament.ID, &tournament.Tournament_Name, &tournament.Created_At, &tournament.Ended_At, &tournament.Version); err != nil {
 			panic(err)
 		}
 		tournaments = append(tournaments, tournament)
@@ -52,10 +57,11 @@ func GetTournamentById(c *gin.Context) {
 	row := db.QueryRow("SELECT * From Tournaments where id = ?", parsedID)
 	log.Print(row, err)
 	var tournament models.Tournament
-	if err := row.Scan(&tournament.ID, &tournament.Tournament_Name, &tournament.Created_At, &tournament.Ended_At); err != nil {
+	if err := row.Scan(&tournament.ID, &tournament.Tournament_Name, &tournament.Created_At, &tournament.Ended_At, &tournament.Version); err != nil {
 		panic(err)
 	}
 
+	c.Header("ETag", etag(tournament.Version))
 	c.IndentedJSON(http.StatusOK, tournament)
 }
 
@@ -83,9 +89,18 @@ func PostTournament(c *gin.Context) {
 	return
 }
 
-// UpdateTournamentById updates a specific tournament by its ID.
+// tournamentReplacement is the payload of a full tournament update; every required field must be supplied.
+type tournamentReplacement struct {
+	Tournament_Name *string `json:"tournament_name" binding:"required"`
+	Created_At      *string `json:"created_at" binding:"required"`
+	Ended_At        *string `json:"ended_at"`
+}
+
+// UpdateTournamentById replaces a specific tournament by its ID.
 // It takes the tournament ID as a URL parameter, parses the JSON payload from the request,
-// updates the corresponding tournament in the database, and returns the updated tournament in JSON format.
+// rejects it if a required field is missing, updates the corresponding tournament in the database,
+// and returns the updated tournament in JSON format. Setting the end date of a running tournament
+// writes a tournament_ended event to the outbox in the same transaction.
 func UpdateTournamentById(c *gin.Context) {
 	db := config.ConnectToDB()
 	id := c.Param("id")
@@ -95,25 +110,355 @@ func UpdateTournamentById(c *gin.Context) {
 		panic(err)
 	}
 
-	var newTournament models.Tournament
+	var newTournament tournamentReplacement
 
 	if err := c.BindJSON(&newTournament); err != nil {
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("updateTournament: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
 		panic(err)
 	}
+	defer tx.Rollback()
 
-	result, err := db.Exec("UPDATE Tournaments SET tournament_name = ?, created_at = ?, ended_at = ? WHERE id = ?", newTournament.Tournament_Name, newTournament.Created_At, newTournament.Ended_At, parsedID)
+	endedBefore, err := tournamentEndedAt(tx, parsedID)
+	if err != nil {
+		respondWriteError(c, "updateTournament", err)
+		return
+	}
+
+	query := "UPDATE Tournaments SET tournament_name = ?, created_at = ?, ended_at = ?, version = version + 1 WHERE id = ?"
+	args := []interface{}{newTournament.Tournament_Name, newTournament.Created_At, newTournament.Ended_At, parsedID}
+	if ifMatch != nil {
+		query += " AND version = ?"
+		args = append(args, *ifMatch)
+	}
+
+	result, err := tx.Exec(query, args...)
 
 	if err != nil {
 		log.Print(result, err)
 		panic(err)
 	}
 
-	row := db.QueryRow("SELECT * FROM Tournaments where id = ?", parsedID)
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = checkVersion(tx, "Tournaments", parsedID, ifMatch)
+		}
+		respondWriteError(c, "updateTournament", err)
+		return
+	}
+
+	row := tx.QueryRow("SELECT * FROM Tournaments where id = ?", parsedID)
 	var updatedTournament models.Tournament
-	if err := row.Scan(&updatedTournament.ID, &updatedTournament.Tournament_Name, &updatedTournament.Created_At, &updatedTournament.Ended_At); err != nil {
+	if err := row.Scan(&updatedTournament.ID, &updatedTournament.Tournament_Name, &updatedTournament.Created_At, &updatedTournament.Ended_At, &updatedTournament.Version); err != nil {
+		panic(err)
+	}
+	if err := announceEnded(tx, endedBefore, updatedTournament); err != nil {
 		panic(err)
 	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	outbox.Default.Notify()
 
+	c.Header("ETag", etag(updatedTournament.Version))
 	c.IndentedJSON(http.StatusCreated, updatedTournament)
 	return
 }
+
+// DeleteTournamentById deletes a tournament together with its houses and enrollments.
+// It takes the tournament ID as a URL parameter and removes, inside a single transaction,
+// every enrollment belonging to the tournament's houses, then the houses and finally the tournament itself.
+// Tournaments whose houses were awarded points are kept along with their ledger history and are refused with a conflict.
+// Students are kept for their other tournaments.
+// It responds with a JSON message indicating success.
+func DeleteTournamentById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteTournament: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteTournament: %v", err)})
+		return
+	}
+
+	if err := checkVersion(tx, "Tournaments", parsedID, ifMatch); err != nil {
+		tx.Rollback()
+		respondWriteError(c, "deleteTournament", err)
+		return
+	}
+
+	if err := removeHouses(tx, "Tournament_ID = ?", parsedID); err != nil {
+		tx.Rollback()
+		respondWriteError(c, "deleteTournament", err)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM Tournaments WHERE ID = ?", parsedID)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		panic(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Tournament and associated houses and enrollments deleted successfully"})
+}
+
+// PatchTournamentById partially updates a specific tournament by its ID.
+// It takes the tournament ID as a URL parameter, applies the JSON Merge Patch payload from the request
+// so that only the supplied fields change, and returns the updated tournament in JSON format.
+// Setting the end date of a running tournament writes a tournament_ended event to the outbox in the same transaction.
+func PatchTournamentById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchTournament: %v", err)})
+		return
+	}
+
+	patch, err := readMergePatch(c.Request.Body)
+	if err != nil {
+		respondWriteError(c, "patchTournament", err)
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchTournament: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+
+	endedBefore, err := tournamentEndedAt(tx, parsedID)
+	if err != nil {
+		respondWriteError(c, "patchTournament", err)
+		return
+	}
+
+	if err := applyMergePatch(tx, "Tournaments", parsedID, patch, tournamentPatchFields, ifMatch); err != nil {
+		respondWriteError(c, "patchTournament", err)
+		return
+	}
+
+	row := tx.QueryRow("SELECT * FROM Tournaments where id = ?", parsedID)
+	var updatedTournament models.Tournament
+	if err := row.Scan(&updatedTournament.ID, &updatedTournament.Tournament_Name, &updatedTournament.Created_At, &updatedTournament.Ended_At, &updatedTournament.Version); err != nil {
+		panic(err)
+	}
+	if err := announceEnded(tx, endedBefore, updatedTournament); err != nil {
+		panic(err)
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	outbox.Default.Notify()
+
+	c.Header("ETag", etag(updatedTournament.Version))
+	c.IndentedJSON(http.StatusOK, updatedTournament)
+}
+
+// tournamentClone is the payload of a tournament clone.
+type tournamentClone struct {
+	Tournament_Name  *string `json:"tournament_name" binding:"required"`
+	Created_At       *string `json:"created_at"`
+	Ended_At         *string `json:"ended_at"`
+	Include_Students bool    `json:"include_students"`
+}
+
+// CloneTournamentById creates a new tournament with the same houses as an existing one.
+// It takes the tournament ID as a URL parameter and the new name, optional dates (created_at defaults to now)
+// and whether to copy student memberships from the JSON payload. Within a single transaction the houses are
+// copied with no points and, with include_students set, every student enrolled in the original tournament who
+// has not been deleted is enrolled in the matching new house, which becomes their current house. Nothing is copied
+// from the points ledger, so houses and students start the new tournament on zero points; the points they earned
+// in the original tournament stay on its ledger.
+// It returns the new tournament and its houses in JSON format.
+func CloneTournamentById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cloneTournament: %v", err)})
+		return
+	}
+
+	var request tournamentClone
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cloneTournament: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := checkVersion(tx, "Tournaments", parsedID, nil); err != nil {
+		respondWriteError(c, "cloneTournament", err)
+		return
+	}
+
+	var tournament models.Tournament
+	result, err := tx.Exec("INSERT INTO Tournaments (tournament_name, created_at, ended_at) VALUES (?, COALESCE(?, CURRENT_TIMESTAMP), ?)", request.Tournament_Name, request.Created_At, request.Ended_At)
+	if err == nil {
+		tournament.ID, err = result.LastInsertId()
+	}
+	if err == nil {
+		err = tx.QueryRow("SELECT * FROM Tournaments WHERE ID = ?", tournament.ID).Scan(&tournament.ID, &tournament.Tournament_Name, &tournament.Created_At, &tournament.Ended_At, &tournament.Version)
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cloneTournament: %v", err)})
+		return
+	}
+
+	rows, err := tx.Query("SELECT ID, House_Name FROM Houses WHERE Tournament_ID = ? ORDER BY ID", parsedID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cloneTournament: %v", err)})
+		return
+	}
+	var originals []models.House
+	for rows.Next() {
+		var house models.House
+		if err := rows.Scan(&house.ID, &house.House_Name); err != nil {
+			rows.Close()
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cloneTournament: %v", err)})
+			return
+		}
+		originals = append(originals, house)
+	}
+	rows.Close()
+
+	houses := []models.House{}
+	var clonedIDs []int64
+	for _, original := range originals {
+		house := models.House{House_Name: original.House_Name, Tournament_ID: tournament.ID, Version: 1}
+		result, err := tx.Exec("INSERT INTO Houses (house_name, house_points, tournament_id) VALUES (?, 0, ?)", house.House_Name, tournament.ID)
+		if err == nil {
+			house.ID, err = result.LastInsertId()
+		}
+		if err == nil && request.Include_Students {
+			_, err = tx.Exec(`INSERT INTO Enrollments (Student_ID, Tournament_ID, House_ID)
+								SELECT Enrollments.Student_ID, ?, ? FROM Enrollments
+								JOIN Students ON Students.ID = Enrollments.Student_ID AND Students.Deleted_At IS NULL
+								WHERE Enrollments.House_ID = ?`, tournament.ID, house.ID, original.ID)
+		}
+		if err == nil && request.Include_Students {
+			var ids []int64
+			ids, err = enrolledStudentIDs(tx, house.ID)
+			clonedIDs = append(clonedIDs, ids...)
+		}
+		if err == nil && request.Include_Students {
+			// Students with points get their new version from the refresh of their totals below,
+			// which brings every total to the new tournament's zero
+			_, err = tx.Exec(`UPDATE Students JOIN Enrollments ON Enrollments.Student_ID = Students.ID
+								SET Students.House_ID = ?, Students.Version = Students.Version + IF(Students.Points = 0, 1, 0)
+								WHERE Enrollments.House_ID = ?`, house.ID, house.ID)
+		}
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cloneTournament: %v", err)})
+			return
+		}
+		houses = append(houses, house)
+	}
+
+	if err := ledger.RefreshStudentTotals(tx, clonedIDs...); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cloneTournament: %v", err)})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cloneTournament: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"tournament": tournament, "houses": houses})
+}
+
+// enrolledStudentIDs returns the IDs of the students enrolled in a house within tx.
+func enrolledStudentIDs(tx *sql.Tx, houseID int64) ([]int64, error) {
+	rows, err := tx.Query("SELECT Student_ID FROM Enrollments WHERE House_ID = ? ORDER BY Student_ID", houseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// tournamentEndedAt reads the end date of a tournament within tx and locks its row until tx ends.
+func tournamentEndedAt(tx *sql.Tx, id int64) (*string, error) {
+	var endedAt *string
+	err := tx.QueryRow("SELECT Ended_At FROM Tournaments WHERE ID = ? FOR UPDATE", id).Scan(&endedAt)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	return endedAt, err
+}
+
+// announceEnded writes a tournament_ended event to the outbox within tx when an update gave a running tournament
+// its end date. endedBefore is the end date before the update. The event holds the tournament and its final standings.
+func announceEnded(tx *sql.Tx, endedBefore *string, tournament models.Tournament) error {
+	if endedBefore != nil || tournament.Ended_At == nil {
+		return nil
+	}
+
+	rows, err := tx.Query("SELECT ID, House_Name, House_Points FROM Houses WHERE Tournament_ID = ? ORDER BY House_Points DESC, ID", tournament.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	standings := []houseTotal{}
+	for rows.Next() {
+		var total houseTotal
+		if err := rows.Scan(&total.House_ID, &total.House_Name, &total.House_Points); err != nil {
+			return err
+		}
+		standings = append(standings, total)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return outbox.Write(tx, events.Event{Type: events.TournamentEnded, Tournament_ID: tournament.ID, Data: gin.H{"tournament": tournament, "standings": standings}})
+}
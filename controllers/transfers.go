@@ -0,0 +1,255 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for transferring students between houses in the house-cup application.
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/events"
+	"github.com/gambinish/house-cup/ledger"
+	"github.com/gambinish/house-cup/models"
+	"github.com/gambinish/house-cup/outbox"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Transfer policies decide what happens to the points a student earned for their old house.
+const (
+	// TransferPolicyStay leaves the points with the old house.
+	TransferPolicyStay = "stay"
+	// TransferPolicyMove moves the points to the new house along with the student.
+	TransferPolicyMove = "move"
+	// TransferPolicyReset removes the points from the old house and from the student's total.
+	TransferPolicyReset = "reset"
+)
+
+// errUseTransfer reports an update that tried to change a student's house directly.
+var errUseTransfer = errors.New("house_id can only be changed through the student transfers endpoint")
+
+// transferRequest is the payload of a student transfer.
+type transferRequest struct {
+	House_ID *int64  `json:"house_id" binding:"required"`
+	Policy   string  `json:"policy" binding:"required"`
+	Notes    *string `json:"notes"`
+}
+
+// rejectHouseChange returns errUseTransfer when houseID differs from the student's current house.
+// Students that are not assigned to a house yet have no points to account for and may be given one.
+func rejectHouseChange(q querier, studentID int64, houseID int64) error {
+	var current sql.NullInt64
+	err := q.QueryRow("SELECT House_ID FROM Students WHERE ID = ? AND Deleted_At IS NULL", studentID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if current.Valid && current.Int64 != houseID {
+		return errUseTransfer
+	}
+	return nil
+}
+
+// TransferStudentById moves a student to another house of a tournament they are enrolled in.
+// It takes the student ID as a URL parameter and parses the target house, point policy and notes
+// from the JSON payload. Within a single transaction it applies the policy to the points the student
+// earned for their old house, updates the student's house and records the transfer in Student_Transfers.
+// It returns the recorded transfer in JSON format.
+func TransferStudentById(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+
+	var request transferRequest
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+	if request.Policy != TransferPolicyStay && request.Policy != TransferPolicyMove && request.Policy != TransferPolicyReset {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("transferStudent: policy must be %q, %q or %q", TransferPolicyStay, TransferPolicyMove, TransferPolicyReset)})
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+
+	if err := checkVersion(tx, "Students", parsedID, ifMatch); err != nil {
+		tx.Rollback()
+		respondWriteError(c, "transferStudent", err)
+		return
+	}
+
+	transfer := models.Transfer{Student_ID: parsedID, To_House_ID: *request.House_ID, Policy: request.Policy, Notes: request.Notes}
+
+	var tournamentID int64
+	err = tx.QueryRow("SELECT Tournament_ID FROM Houses WHERE ID = ?", transfer.To_House_ID).Scan(&tournamentID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("house %d not found", transfer.To_House_ID)})
+		return
+	}
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+
+	// Students can only move between houses of a tournament they are enrolled in
+	err = tx.QueryRow("SELECT House_ID FROM Enrollments WHERE Student_ID = ? AND Tournament_ID = ? FOR UPDATE", parsedID, tournamentID).Scan(&transfer.From_House_ID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("transferStudent: student is not enrolled in tournament %d, enroll them instead", tournamentID)})
+		return
+	}
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+	if transfer.From_House_ID == transfer.To_House_ID {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": "transferStudent: student is already in that house"})
+		return
+	}
+
+	// Only the points earned for the old house are subject to the policy
+	err = tx.QueryRow("SELECT COALESCE(SUM(Points), 0) FROM Student_House_Points WHERE Student_ID = ? AND House_ID = ?", parsedID, transfer.From_House_ID).Scan(&transfer.Points_Moved)
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+
+	switch request.Policy {
+	case TransferPolicyStay:
+		transfer.Points_Moved = 0
+	case TransferPolicyMove:
+		err = moveStudentPoints(tx, parsedID, transfer.From_House_ID, transfer.To_House_ID, transfer.Points_Moved)
+	case TransferPolicyReset:
+		if transfer.Points_Moved != 0 {
+			reset := models.Point{
+				Points:     -transfer.Points_Moved,
+				Notes:      fmt.Sprintf("Points reset on transfer to house %d", transfer.To_House_ID),
+				Student_ID: &parsedID,
+				House_ID:   transfer.From_House_ID,
+				Kind:       ledger.Adjustment,
+			}
+			_, err = ledger.Append(tx, reset)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+
+	_, err = tx.Exec("UPDATE Enrollments SET House_ID = ? WHERE Student_ID = ? AND Tournament_ID = ?", transfer.To_House_ID, parsedID, tournamentID)
+	if err == nil {
+		// The student's current house only follows when the transfer is in their current tournament
+		_, err = tx.Exec("UPDATE Students SET House_ID = IF(House_ID = ?, ?, House_ID), Version = Version + 1 WHERE ID = ?", transfer.From_House_ID, transfer.To_House_ID, parsedID)
+	}
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+
+	result, err := tx.Exec(`INSERT INTO Student_Transfers (Student_ID, From_House_ID, To_House_ID, Policy, Points_Moved, Notes)
+							VALUES (?, ?, ?, ?, ?, ?)`,
+		transfer.Student_ID, transfer.From_House_ID, transfer.To_House_ID, transfer.Policy, transfer.Points_Moved, transfer.Notes)
+	if err == nil {
+		transfer.ID, err = result.LastInsertId()
+	}
+	if err == nil {
+		err = tx.QueryRow("SELECT Transferred_At FROM Student_Transfers WHERE ID = ?", transfer.ID).Scan(&transfer.Transferred_At)
+	}
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+
+	err = announce(tx, []events.Event{{Type: events.Transfer, House_ID: transfer.To_House_ID, Data: transfer}}, transfer.From_House_ID)
+	if err != nil {
+		tx.Rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("transferStudent: %v", err)})
+		return
+	}
+	outbox.Default.Notify()
+
+	c.IndentedJSON(http.StatusCreated, transfer)
+}
+
+// moveStudentPoints moves the points a student earned for one house to another within tx
+// by appending a pair of transfer records to the ledger: their sum off the old house and onto the new one.
+func moveStudentPoints(tx *sql.Tx, studentID int64, fromHouseID int64, toHouseID int64, total int64) error {
+	if total == 0 {
+		return nil
+	}
+	_, err := ledger.Append(tx,
+		models.Point{Points: -total, Notes: fmt.Sprintf("Points moved to house %d", toHouseID), Student_ID: &studentID, House_ID: fromHouseID, Kind: ledger.Transfer},
+		models.Point{Points: total, Notes: fmt.Sprintf("Points moved from house %d", fromHouseID), Student_ID: &studentID, House_ID: toHouseID, Kind: ledger.Transfer},
+	)
+	return err
+}
+
+// GetTransfersByStudentId retrieves the transfer history of a specific student.
+// It takes the student ID as a URL parameter, queries the database for the student's transfers,
+// and returns them oldest first in JSON format.
+func GetTransfersByStudentId(c *gin.Context) {
+	db := config.ConnectToDB()
+	id := c.Param("id")
+
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getTransfers: %v", err)})
+		return
+	}
+
+	rows, err := db.Query("SELECT * FROM Student_Transfers WHERE Student_ID = ? ORDER BY ID", parsedID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getTransfers: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	transfers := []models.Transfer{}
+	// Loop through rows, using Scan to assign column data to struct fields.
+	for rows.Next() {
+		var transfer models.Transfer
+		if err := rows.Scan(&transfer.ID, &transfer.Student_ID, &transfer.From_House_ID, &transfer.To_House_ID, &transfer.Policy, &transfer.Points_Moved, &transfer.Notes, &transfer.Transferred_At); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getTransfers: %v", err)})
+			return
+		}
+		transfers = append(transfers, transfer)
+	}
+	if err := rows.Err(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getTransfers: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, transfers)
+}
@@ -0,0 +1,411 @@
+// Package controllers provides HTTP request handlers (controllers)
+// for registering outbound webhooks and inspecting their deliveries in the house-cup application.
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gambinish/house-cup/models"
+	"github.com/gambinish/house-cup/webhooks"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookColumns lists the Webhooks columns in the order scanWebhook reads them.
+const webhookColumns = "ID, URL, Secret, Event_Types, Active, Created_At, Version"
+
+// webhookDeliveryColumns lists the Webhook_Deliveries columns in the order scanWebhookDelivery reads them.
+const webhookDeliveryColumns = `ID, Webhook_ID, Event_Type, Payload, Status, Attempts, Next_Attempt_At, Last_Attempt_At,
+								Response_Status, Last_Error, Delivered_At, Redelivery_Of, Created_At`
+
+// scanWebhook reads a row of webhookColumns. The secret is only kept when withSecret is set.
+func scanWebhook(row interface{ Scan(...interface{}) error }, withSecret bool) (models.Webhook, error) {
+	var webhook models.Webhook
+	var eventTypes sql.NullString
+	err := row.Scan(&webhook.ID, &webhook.URL, &webhook.Secret, &eventTypes, &webhook.Active, &webhook.Created_At, &webhook.Version)
+	if !withSecret {
+		webhook.Secret = ""
+	}
+	webhook.Event_Types = webhooks.Types
+	if eventTypes.Valid {
+		webhook.Event_Types = strings.Split(eventTypes.String, ",")
+	}
+	return webhook, err
+}
+
+// scanWebhookDelivery reads a row of webhookDeliveryColumns.
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := row.Scan(&delivery.ID, &delivery.Webhook_ID, &delivery.Event_Type, &delivery.Payload, &delivery.Status, &delivery.Attempts,
+		&delivery.Next_Attempt_At, &delivery.Last_Attempt_At, &delivery.Response_Status, &delivery.Last_Error,
+		&delivery.Delivered_At, &delivery.Redelivery_Of, &delivery.Created_At)
+	return delivery, err
+}
+
+// webhookURL checks that value is an absolute http or https URL whose host is reachable outside the internal network.
+func webhookURL(value string) (string, error) {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return "", fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if err := webhooks.CheckHost(parsed.Hostname()); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// webhookEventTypes checks event types and joins them for the Event_Types column.
+// An empty list subscribes to every event type, which is stored as NULL.
+func webhookEventTypes(eventTypes []string) (interface{}, error) {
+	if len(eventTypes) == 0 {
+		return nil, nil
+	}
+	for _, eventType := range eventTypes {
+		if !webhooks.KnownType(eventType) {
+			return nil, fmt.Errorf("unknown event type %q, use one of %s", eventType, strings.Join(webhooks.Types, ", "))
+		}
+	}
+	return strings.Join(eventTypes, ","), nil
+}
+
+// urlField decodes the url member of a webhook patch.
+func urlField(raw json.RawMessage) (interface{}, error) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return webhookURL(value)
+}
+
+// eventTypesField decodes the event_types member of a webhook patch.
+func eventTypesField(raw json.RawMessage) (interface{}, error) {
+	var value []string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return webhookEventTypes(value)
+}
+
+// boolField decodes a JSON boolean member.
+func boolField(raw json.RawMessage) (interface{}, error) {
+	var value bool
+	err := json.Unmarshal(raw, &value)
+	return value, err
+}
+
+// webhookPatchFields are the fields accepted by PatchWebhookById.
+var webhookPatchFields = map[string]patchField{
+	"url":         {column: "URL", decode: urlField},
+	"event_types": {column: "Event_Types", nullable: true, decode: eventTypesField},
+	"active":      {column: "Active", decode: boolField},
+}
+
+// webhookRegistration is the payload of a new webhook.
+type webhookRegistration struct {
+	URL         string   `json:"url" binding:"required"`
+	Secret      string   `json:"secret"`
+	Event_Types []string `json:"event_types"`
+	Active      *bool    `json:"active"`
+}
+
+// GetWebhooks retrieves all registered webhooks from the database.
+// Secrets are left out; they are only returned when a webhook is registered.
+// It returns the webhooks in JSON format.
+func GetWebhooks(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	rows, err := db.Query("SELECT " + webhookColumns + " FROM Webhooks ORDER BY ID")
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getWebhooks: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	hooks := []models.Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows, false)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getWebhooks: %v", err)})
+			return
+		}
+		hooks = append(hooks, webhook)
+	}
+	c.IndentedJSON(http.StatusOK, hooks)
+}
+
+// GetWebhookById retrieves a specific webhook by its ID.
+// It takes the webhook ID as a URL parameter and returns the webhook, without its secret, in JSON format.
+func GetWebhookById(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	parsedID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getWebhook: %v", err)})
+		return
+	}
+
+	webhook, err := scanWebhook(db.QueryRow("SELECT "+webhookColumns+" FROM Webhooks WHERE ID = ?", parsedID), false)
+	if err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	if err != nil {
+		respondWriteError(c, "getWebhook", err)
+		return
+	}
+	c.Header("ETag", etag(webhook.Version))
+	c.IndentedJSON(http.StatusOK, webhook)
+}
+
+// PostWebhook registers a webhook.
+// It parses the URL, the optional event types to subscribe to (every type when empty), the optional active flag
+// and an optional signing secret from the JSON payload. A random secret is generated when none is given.
+// It returns the new webhook, including its secret, in JSON format. Retries replayed through an Idempotency-Key
+// omit the secret, which is not stored with the replay.
+func PostWebhook(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	var registration webhookRegistration
+	if err := c.BindJSON(&registration); err != nil {
+		return
+	}
+
+	hookURL, err := webhookURL(registration.URL)
+	var eventTypes interface{}
+	if err == nil {
+		eventTypes, err = webhookEventTypes(registration.Event_Types)
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("postWebhook: %v", err)})
+		return
+	}
+
+	secret := registration.Secret
+	if secret == "" {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postWebhook: %v", err)})
+			return
+		}
+		secret = hex.EncodeToString(random)
+	}
+	active := registration.Active == nil || *registration.Active
+
+	result, err := db.Exec("INSERT INTO Webhooks (URL, Secret, Event_Types, Active) VALUES (?, ?, ?, ?)", hookURL, secret, eventTypes, active)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postWebhook: %v", err)})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postWebhook: %v", err)})
+		return
+	}
+
+	webhook, err := scanWebhook(db.QueryRow("SELECT "+webhookColumns+" FROM Webhooks WHERE ID = ?", id), true)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("postWebhook: %v", err)})
+		return
+	}
+	c.Header("ETag", etag(webhook.Version))
+	c.IndentedJSON(http.StatusCreated, webhook)
+}
+
+// PatchWebhookById partially updates a specific webhook by its ID.
+// It takes the webhook ID as a URL parameter and applies the JSON Merge Patch payload from the request,
+// which may change its url, event_types (null subscribes to every type) and active flag.
+// It returns the updated webhook in JSON format.
+func PatchWebhookById(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	parsedID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchWebhook: %v", err)})
+		return
+	}
+
+	patch, err := readMergePatch(c.Request.Body)
+	if err != nil {
+		respondWriteError(c, "patchWebhook", err)
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("patchWebhook: %v", err)})
+		return
+	}
+
+	if err := applyMergePatch(db, "Webhooks", parsedID, patch, webhookPatchFields, ifMatch); err != nil {
+		respondWriteError(c, "patchWebhook", err)
+		return
+	}
+
+	webhook, err := scanWebhook(db.QueryRow("SELECT "+webhookColumns+" FROM Webhooks WHERE ID = ?", parsedID), false)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("patchWebhook: %v", err)})
+		return
+	}
+	// A reactivated webhook may have deliveries waiting
+	webhooks.Default.Notify()
+
+	c.Header("ETag", etag(webhook.Version))
+	c.IndentedJSON(http.StatusOK, webhook)
+}
+
+// DeleteWebhookById deletes a webhook together with its delivery log.
+// It takes the webhook ID as a URL parameter and responds with a JSON message indicating success.
+func DeleteWebhookById(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	parsedID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteWebhook: %v", err)})
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("deleteWebhook: %v", err)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteWebhook: %v", err)})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := checkVersion(tx, "Webhooks", parsedID, ifMatch); err != nil {
+		respondWriteError(c, "deleteWebhook", err)
+		return
+	}
+
+	// Redeliveries point at the deliveries they repeat, so unlink them before deleting the log
+	_, err = tx.Exec("UPDATE Webhook_Deliveries SET Redelivery_Of = NULL WHERE Webhook_ID = ?", parsedID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM Webhook_Deliveries WHERE Webhook_ID = ?", parsedID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM Webhooks WHERE ID = ?", parsedID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleteWebhook: %v", err)})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Webhook and its deliveries deleted successfully"})
+}
+
+// GetDeliveriesByWebhookId retrieves the delivery log of a webhook, newest first.
+// It takes the webhook ID as a URL parameter and an optional status query parameter
+// (pending, succeeded or failed), and returns at most limit deliveries (50 by default) in JSON format.
+func GetDeliveriesByWebhookId(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	parsedID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getDeliveries: %v", err)})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "getDeliveries: limit must be between 1 and 500"})
+		return
+	}
+
+	if err := checkVersion(db, "Webhooks", parsedID, nil); err != nil {
+		respondWriteError(c, "getDeliveries", err)
+		return
+	}
+
+	query := "SELECT " + webhookDeliveryColumns + " FROM Webhook_Deliveries WHERE Webhook_ID = ?"
+	args := []interface{}{parsedID}
+	if status := c.Query("status"); status != "" {
+		if status != webhooks.Pending && status != webhooks.Succeeded && status != webhooks.Failed {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("getDeliveries: unknown status %q", status)})
+			return
+		}
+		query += " AND Status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY ID DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getDeliveries: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getDeliveries: %v", err)})
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	c.IndentedJSON(http.StatusOK, deliveries)
+}
+
+// RedeliverWebhookDelivery queues a delivery of a webhook again.
+// It takes the webhook ID and the delivery ID as URL parameters and queues a new delivery with the same payload,
+// linked to the original through redelivery_of, leaving the original's log entry untouched.
+// It returns the new delivery in JSON format with status 202; it is sent in the background.
+func RedeliverWebhookDelivery(c *gin.Context) {
+	db := config.ConnectToDB()
+
+	webhookID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("redeliver: %v", err)})
+		return
+	}
+	deliveryID, err := strconv.ParseInt(c.Param("delivery_id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("redeliver: %v", err)})
+		return
+	}
+
+	result, err := db.Exec(`INSERT INTO Webhook_Deliveries (Webhook_ID, Event_Type, Payload, Redelivery_Of)
+							SELECT Webhook_ID, Event_Type, Payload, ID FROM Webhook_Deliveries
+							WHERE ID = ? AND Webhook_ID = ?`, deliveryID, webhookID)
+	var affected int64
+	if err == nil {
+		affected, err = result.RowsAffected()
+	}
+	if err == nil && affected == 0 {
+		err = fmt.Errorf("delivery %d of webhook %d: %w", deliveryID, webhookID, errNotFound)
+	}
+	var id int64
+	if err == nil {
+		id, err = result.LastInsertId()
+	}
+	if err != nil {
+		respondWriteError(c, "redeliver", err)
+		return
+	}
+	webhooks.Default.Notify()
+
+	delivery, err := scanWebhookDelivery(db.QueryRow("SELECT "+webhookDeliveryColumns+" FROM Webhook_Deliveries WHERE ID = ?", id))
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("redeliver: %v", err)})
+		return
+	}
+	c.IndentedJSON(http.StatusAccepted, delivery)
+}
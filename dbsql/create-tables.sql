@@ -1,3 +1,14 @@
+DROP TABLE IF EXISTS Student_Achievements;
+DROP TABLE IF EXISTS Multipliers;
+DROP TABLE IF EXISTS Audit_Log;
+DROP TABLE IF EXISTS Outbox_Deliveries;
+DROP TABLE IF EXISTS Outbox;
+DROP TABLE IF EXISTS Webhook_Deliveries;
+DROP TABLE IF EXISTS Webhooks;
+DROP TABLE IF EXISTS Student_House_Points;
+DROP TABLE IF EXISTS Idempotency_Keys;
+DROP TABLE IF EXISTS Enrollments;
+DROP TABLE IF EXISTS Student_Transfers;
 DROP TABLE IF EXISTS Points;
 DROP TABLE IF EXISTS Students;
 DROP TABLE IF EXISTS Houses;
@@ -8,7 +19,8 @@ CREATE TABLE Tournaments (
     ID INT AUTO_INCREMENT PRIMARY KEY,
     Tournament_Name VARCHAR(255) NOT NULL,
     Created_At TIMESTAMP NOT NULL,
-    Ended_At TIMESTAMP
+    Ended_At TIMESTAMP,
+    Version INT NOT NULL DEFAULT 1
 );
 
 -- Create House table
@@ -17,7 +29,8 @@ CREATE TABLE Houses (
     House_Name VARCHAR(255) NOT NULL,
     House_Points INT NOT NULL,
     Tournament_ID INT,
-    FOREIGN KEY (Tournament_ID) REFERENCES Tournaments(ID)
+    FOREIGN KEY (Tournament_ID) REFERENCES Tournaments(ID),
+    Version INT NOT NULL DEFAULT 1
 );
 
 -- Create Student table
@@ -26,7 +39,11 @@ CREATE TABLE Students (
     Student_Name VARCHAR(255) NOT NULL,
     Points INT NOT NULL,
     House_ID INT,
-    FOREIGN KEY (House_ID) REFERENCES Houses(ID)
+    FOREIGN KEY (House_ID) REFERENCES Houses(ID),
+    Version INT NOT NULL DEFAULT 1,
+    External_ID VARCHAR(255) UNIQUE,
+    Deleted_At TIMESTAMP NULL,
+    Deletion_Policy VARCHAR(16)
 );
 
 -- Create Point table
@@ -37,5 +54,182 @@ CREATE TABLE Points (
     Student_ID INT,
     FOREIGN KEY (Student_ID) REFERENCES Students(ID),
     House_ID INT NOT NULL,
-    FOREIGN KEY (House_ID) REFERENCES Houses(ID)
+    FOREIGN KEY (House_ID) REFERENCES Houses(ID) ON DELETE RESTRICT,
+    Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    Kind VARCHAR(16) NOT NULL DEFAULT 'award',
+    Reverses_ID INT UNIQUE,
+    FOREIGN KEY (Reverses_ID) REFERENCES Points(ID) ON DELETE RESTRICT,
+    Raw_Points INT NOT NULL,
+    Category VARCHAR(64),
+    Multiplier_IDs VARCHAR(255)
+);
+
+-- Points is an immutable ledger: records are corrected by appending reversals and adjustments.
+-- They are never deleted: the foreign keys restrict deleting the houses they were awarded to.
+CREATE TRIGGER Points_No_Update BEFORE UPDATE ON Points
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Points is append-only';
+
+CREATE TRIGGER Points_No_Delete BEFORE DELETE ON Points
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Points is append-only';
+
+-- Create Idempotency_Keys table
+CREATE TABLE Idempotency_Keys (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Idempotency_Key VARCHAR(255) NOT NULL,
+    Method VARCHAR(10) NOT NULL,
+    Path VARCHAR(255) NOT NULL,
+    Request_Hash CHAR(64) NOT NULL,
+    Status_Code INT,
+    Content_Type VARCHAR(255),
+    Response_Body MEDIUMTEXT,
+    Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (Idempotency_Key, Method, Path)
+);
+
+-- Create Student_Transfers table
+CREATE TABLE Student_Transfers (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Student_ID INT NOT NULL,
+    FOREIGN KEY (Student_ID) REFERENCES Students(ID),
+    From_House_ID INT NOT NULL,
+    FOREIGN KEY (From_House_ID) REFERENCES Houses(ID),
+    To_House_ID INT NOT NULL,
+    FOREIGN KEY (To_House_ID) REFERENCES Houses(ID),
+    Policy VARCHAR(16) NOT NULL,
+    Points_Moved INT NOT NULL,
+    Notes VARCHAR(255),
+    Transferred_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create Enrollments table
+CREATE TABLE Enrollments (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Student_ID INT NOT NULL,
+    FOREIGN KEY (Student_ID) REFERENCES Students(ID),
+    Tournament_ID INT NOT NULL,
+    FOREIGN KEY (Tournament_ID) REFERENCES Tournaments(ID),
+    House_ID INT NOT NULL,
+    FOREIGN KEY (House_ID) REFERENCES Houses(ID),
+    Enrolled_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (Student_ID, Tournament_ID)
+);
+
+-- Create Webhooks table
+CREATE TABLE Webhooks (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    URL VARCHAR(2048) NOT NULL,
+    Secret VARCHAR(255) NOT NULL,
+    Event_Types VARCHAR(255),
+    Active BOOLEAN NOT NULL DEFAULT TRUE,
+    Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    Version INT NOT NULL DEFAULT 1
+);
+
+-- Create Webhook_Deliveries table
+CREATE TABLE Webhook_Deliveries (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Webhook_ID INT NOT NULL,
+    FOREIGN KEY (Webhook_ID) REFERENCES Webhooks(ID),
+    Event_Type VARCHAR(64) NOT NULL,
+    Payload MEDIUMTEXT NOT NULL,
+    Status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    Attempts INT NOT NULL DEFAULT 0,
+    Next_Attempt_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    Last_Attempt_At TIMESTAMP NULL,
+    Response_Status INT,
+    Last_Error VARCHAR(1024),
+    Delivered_At TIMESTAMP NULL,
+    Redelivery_Of INT,
+    FOREIGN KEY (Redelivery_Of) REFERENCES Webhook_Deliveries(ID),
+    Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX (Status, Next_Attempt_At)
+);
+
+-- Create Outbox table
+CREATE TABLE Outbox (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Event_Type VARCHAR(64) NOT NULL,
+    Tournament_ID INT NOT NULL DEFAULT 0,
+    House_ID INT NOT NULL DEFAULT 0,
+    Payload MEDIUMTEXT NOT NULL,
+    Created_At TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX (Created_At)
+);
+
+-- Create Outbox_Deliveries table
+CREATE TABLE Outbox_Deliveries (
+    Outbox_ID INT NOT NULL,
+    FOREIGN KEY (Outbox_ID) REFERENCES Outbox(ID),
+    Sink VARCHAR(255) NOT NULL,
+    Delivered_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (Outbox_ID, Sink)
+);
+
+-- Create Audit_Log table, which is only ever appended to
+CREATE TABLE Audit_Log (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Occurred_At TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    Request_ID VARCHAR(64) NOT NULL,
+    Actor VARCHAR(255) NOT NULL,
+    Action VARCHAR(255) NOT NULL,
+    Method VARCHAR(10) NOT NULL,
+    Path VARCHAR(2048) NOT NULL,
+    Entity VARCHAR(64) NOT NULL,
+    Entity_ID VARCHAR(255),
+    Status_Code INT NOT NULL,
+    Before_JSON JSON,
+    After_JSON JSON,
+    Client_IP VARCHAR(64) NOT NULL,
+    INDEX (Entity, Entity_ID),
+    INDEX (Actor),
+    INDEX (Request_ID),
+    INDEX (Occurred_At)
+);
+
+CREATE TRIGGER Audit_Log_No_Update BEFORE UPDATE ON Audit_Log
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Audit_Log is append-only';
+
+CREATE TRIGGER Audit_Log_No_Delete BEFORE DELETE ON Audit_Log
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Audit_Log is append-only';
+
+-- Create Student_House_Points table, the projection of the points each student earned for each house
+CREATE TABLE Student_House_Points (
+    Student_ID INT NOT NULL,
+    FOREIGN KEY (Student_ID) REFERENCES Students(ID),
+    House_ID INT NOT NULL,
+    FOREIGN KEY (House_ID) REFERENCES Houses(ID) ON DELETE CASCADE,
+    Points INT NOT NULL,
+    PRIMARY KEY (Student_ID, House_ID)
+);
+
+-- Create Multipliers table, the time-boxed rules that scale awards
+CREATE TABLE Multipliers (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Multiplier_Name VARCHAR(255) NOT NULL,
+    Factor DECIMAL(6,3) NOT NULL,
+    Tournament_ID INT,
+    FOREIGN KEY (Tournament_ID) REFERENCES Tournaments(ID) ON DELETE CASCADE,
+    House_ID INT,
+    FOREIGN KEY (House_ID) REFERENCES Houses(ID) ON DELETE CASCADE,
+    Category VARCHAR(64),
+    Starts_At TIMESTAMP NOT NULL,
+    Ends_At TIMESTAMP NOT NULL,
+    Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    Version INT NOT NULL DEFAULT 1,
+    INDEX (Starts_At, Ends_At),
+    CHECK (Factor > 0),
+    CHECK (Ends_At > Starts_At)
+);
+
+-- Create Student_Achievements table, the achievements each student was granted
+CREATE TABLE Student_Achievements (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Student_ID INT NOT NULL,
+    FOREIGN KEY (Student_ID) REFERENCES Students(ID),
+    Achievement_Key VARCHAR(64) NOT NULL,
+    Achievement_Name VARCHAR(255) NOT NULL,
+    Point_ID INT,
+    FOREIGN KEY (Point_ID) REFERENCES Points(ID) ON DELETE SET NULL,
+    Granted_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (Student_ID, Achievement_Key)
 );
\ No newline at end of file
@@ -1,3 +1,14 @@
+DROP TABLE IF EXISTS Student_Achievements;
+DROP TABLE IF EXISTS Multipliers;
+DROP TABLE IF EXISTS Student_House_Points;
+DROP TABLE IF EXISTS Audit_Log;
+DROP TABLE IF EXISTS Outbox_Deliveries;
+DROP TABLE IF EXISTS Outbox;
+DROP TABLE IF EXISTS Webhook_Deliveries;
+DROP TABLE IF EXISTS Webhooks;
+DROP TABLE IF EXISTS Idempotency_Keys;
+DROP TABLE IF EXISTS Enrollments;
+DROP TABLE IF EXISTS Student_Transfers;
 DROP TABLE IF EXISTS Points;
 DROP TABLE IF EXISTS Students;
 DROP TABLE IF EXISTS Houses;
@@ -1,44 +1,6 @@
-DROP TABLE IF EXISTS Points;
-DROP TABLE IF EXISTS Students;
-DROP TABLE IF EXISTS Houses;
-DROP TABLE IF EXISTS Tournaments;
+-- Create the tables from the current schema; run this script from the repository root
+SOURCE dbsql/create-tables.sql;
 
--- Create Tournament table
-CREATE TABLE Tournaments (
-    ID INT AUTO_INCREMENT PRIMARY KEY,
-    Tournament_Name VARCHAR(255) NOT NULL,
-    Created_At TIMESTAMP NOT NULL,
-    Ended_At TIMESTAMP
-);
-
--- Create House table
-CREATE TABLE Houses (
-    ID INT AUTO_INCREMENT PRIMARY KEY,
-    House_Name VARCHAR(255) NOT NULL,
-    House_Points INT NOT NULL,
-    Tournament_ID INT,
-    FOREIGN KEY (Tournament_ID) REFERENCES Tournaments(ID)
-);
-
--- Create Student table
-CREATE TABLE Students (
-    ID INT AUTO_INCREMENT PRIMARY KEY,
-    Student_Name VARCHAR(255) NOT NULL,
-    Points INT NOT NULL,
-    House_ID INT,
-    FOREIGN KEY (House_ID) REFERENCES Houses(ID)
-);
-
--- Create Point table
-CREATE TABLE Points (
-    ID INT AUTO_INCREMENT PRIMARY KEY,
-    Points INT NOT NULL,
-    Notes VARCHAR(255),
-    Student_ID INT,
-    FOREIGN KEY (Student_ID) REFERENCES Students(ID),
-    House_ID INT NOT NULL,
-    FOREIGN KEY (House_ID) REFERENCES Houses(ID)
-);
 -- Seed Data
 
 -- Insert seed data for Tournament table
@@ -56,10 +18,11 @@ VALUES
   ('Slytherin', 7, 1),
   ('Ravenclaw', 10, 1),
   ('Hufflepuff', 11, 1),
-  ('Durmstrang', 8, 2),
+  ('Durmstrang', 11, 2),
   ('Beauxbatons', 7, 2);
 
--- Insert seed data for Student table
+-- Insert seed data for Student table; a student's points are their total for the tournament of their current house.
+-- Cedric Diggory took part in both tournaments as one student, enrolled in a house of each.
 INSERT INTO Students
   (Student_Name, Points, House_ID)
 VALUES
@@ -68,21 +31,44 @@ VALUES
   ('Ron Weasley', 8, 1),
   ('Draco Malfoy', 7, 2),
   ('Luna Lovegood', 10, 3),
-  ('Cedric Diggory', 11, 4),
+  ('Cedric Diggory', 3, 5),
   ('Fleur Delacour', 7, 6),
   ('Viktor Krum', 8, 5),
   ('Cho Chang', 0, 3);
 
 -- Insert seed data for Points table
 INSERT INTO Points
-  (Points, Notes, Student_ID, House_ID)
+  (Points, Raw_Points, Notes, Student_ID, House_ID)
+VALUES
+  (10, 10, 'Quidditch match victory', 1, 1),
+  (5, 5, 'Excellent potion brewing', 2, 1),
+  (8, 8, 'Prefect duties', 3, 1),
+  (7, 7, 'Slytherin common room points', 4, 2),
+  (10, 10, 'Outstanding in Charms class', 5, 3),
+  (5, 5, 'Herbology achievement', 6, 4),
+  (8, 8, 'Durmstrang team victory', 8, 5),
+  (7, 7, 'Beauxbatons team victory', 7, 6),
+  (6, 6, 'Participation in Triwizard Tournament', 6, 4),
+  (3, 3, 'Triwizard first task', 6, 5);
+
+-- Project the seeded points each student earned for each house
+INSERT INTO Student_House_Points (Student_ID, House_ID, Points)
+SELECT Student_ID, House_ID, SUM(Points)
+FROM Points
+WHERE Student_ID IS NOT NULL
+GROUP BY Student_ID, House_ID;
+
+-- Insert seed data for Enrollments table
+INSERT INTO Enrollments
+  (Student_ID, Tournament_ID, House_ID, Enrolled_At)
 VALUES
-  (10, 'Quidditch match victory', 1, 1),
-  (5, 'Excellent potion brewing', 2, 1),
-  (8, 'Prefect duties', 3, 1),
-  (7, 'Slytherin common room points', 4, 2),
-  (10, 'Outstanding in Charms class', 5, 3),
-  (5, 'Herbology achievement', 6, 4),
-  (8, 'Durmstrang team victory', 8, 5),
-  (7, 'Beauxbatons team victory', 7, 6),
-  (6, 'Participation in Triwizard Tournament', 6, 4);
\ No newline at end of file
+  (1, 1, 1, '2023-01-01 00:00:00'),
+  (2, 1, 1, '2023-01-01 00:00:00'),
+  (3, 1, 1, '2023-01-01 00:00:00'),
+  (4, 1, 2, '2023-01-01 00:00:00'),
+  (5, 1, 3, '2023-01-01 00:00:00'),
+  (6, 1, 4, '2023-01-01 00:00:00'),
+  (6, 2, 5, '2023-05-15 12:30:00'),
+  (7, 2, 6, '2023-05-15 12:30:00'),
+  (8, 2, 5, '2023-05-15 12:30:00'),
+  (9, 1, 3, '2023-01-01 00:00:00');
\ No newline at end of file
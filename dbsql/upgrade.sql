@@ -0,0 +1,251 @@
+-- Upgrade a database created from the original schema (Tournaments, Houses, Students and Points only)
+-- to the current one. Apply it once, in order; statements only add to the schema and backfill the new columns
+-- and tables from the existing rows, so nothing is dropped. New databases use create-tables.sql instead.
+
+-- Add row versions
+ALTER TABLE Tournaments ADD COLUMN Version INT NOT NULL DEFAULT 1;
+ALTER TABLE Houses ADD COLUMN Version INT NOT NULL DEFAULT 1;
+
+-- Add external IDs, row versions and soft deletes to students
+ALTER TABLE Students
+    ADD COLUMN Version INT NOT NULL DEFAULT 1,
+    ADD COLUMN External_ID VARCHAR(255) UNIQUE,
+    ADD COLUMN Deleted_At TIMESTAMP NULL,
+    ADD COLUMN Deletion_Policy VARCHAR(16);
+
+-- Turn points into a ledger; existing records are awards made at upgrade time, for their amount as given
+ALTER TABLE Points
+    ADD COLUMN Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN Kind VARCHAR(16) NOT NULL DEFAULT 'award',
+    ADD COLUMN Reverses_ID INT UNIQUE,
+    ADD FOREIGN KEY (Reverses_ID) REFERENCES Points(ID) ON DELETE RESTRICT,
+    ADD COLUMN Raw_Points INT,
+    ADD COLUMN Category VARCHAR(64),
+    ADD COLUMN Multiplier_IDs VARCHAR(255);
+
+UPDATE Points SET Raw_Points = Points;
+
+ALTER TABLE Points MODIFY Raw_Points INT NOT NULL;
+
+-- Create Idempotency_Keys table
+CREATE TABLE Idempotency_Keys (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Idempotency_Key VARCHAR(255) NOT NULL,
+    Method VARCHAR(10) NOT NULL,
+    Path VARCHAR(255) NOT NULL,
+    Request_Hash CHAR(64) NOT NULL,
+    Status_Code INT,
+    Content_Type VARCHAR(255),
+    Response_Body MEDIUMTEXT,
+    Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (Idempotency_Key, Method, Path)
+);
+
+-- Create Student_Transfers table
+CREATE TABLE Student_Transfers (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Student_ID INT NOT NULL,
+    FOREIGN KEY (Student_ID) REFERENCES Students(ID),
+    From_House_ID INT NOT NULL,
+    FOREIGN KEY (From_House_ID) REFERENCES Houses(ID),
+    To_House_ID INT NOT NULL,
+    FOREIGN KEY (To_House_ID) REFERENCES Houses(ID),
+    Policy VARCHAR(16) NOT NULL,
+    Points_Moved INT NOT NULL,
+    Notes VARCHAR(255),
+    Transferred_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create Enrollments table
+CREATE TABLE Enrollments (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Student_ID INT NOT NULL,
+    FOREIGN KEY (Student_ID) REFERENCES Students(ID),
+    Tournament_ID INT NOT NULL,
+    FOREIGN KEY (Tournament_ID) REFERENCES Tournaments(ID),
+    House_ID INT NOT NULL,
+    FOREIGN KEY (House_ID) REFERENCES Houses(ID),
+    Enrolled_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (Student_ID, Tournament_ID)
+);
+
+-- Enroll existing students in the tournament of their current house
+INSERT INTO Enrollments (Student_ID, Tournament_ID, House_ID)
+SELECT Students.ID, Houses.Tournament_ID, Houses.ID
+FROM Students
+JOIN Houses ON Students.House_ID = Houses.ID
+WHERE Houses.Tournament_ID IS NOT NULL;
+
+-- Create Webhooks table
+CREATE TABLE Webhooks (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    URL VARCHAR(2048) NOT NULL,
+    Secret VARCHAR(255) NOT NULL,
+    Event_Types VARCHAR(255),
+    Active BOOLEAN NOT NULL DEFAULT TRUE,
+    Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    Version INT NOT NULL DEFAULT 1
+);
+
+-- Create Webhook_Deliveries table
+CREATE TABLE Webhook_Deliveries (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Webhook_ID INT NOT NULL,
+    FOREIGN KEY (Webhook_ID) REFERENCES Webhooks(ID),
+    Event_Type VARCHAR(64) NOT NULL,
+    Payload MEDIUMTEXT NOT NULL,
+    Status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    Attempts INT NOT NULL DEFAULT 0,
+    Next_Attempt_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    Last_Attempt_At TIMESTAMP NULL,
+    Response_Status INT,
+    Last_Error VARCHAR(1024),
+    Delivered_At TIMESTAMP NULL,
+    Redelivery_Of INT,
+    FOREIGN KEY (Redelivery_Of) REFERENCES Webhook_Deliveries(ID),
+    Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX (Status, Next_Attempt_At)
+);
+
+-- Create Outbox table
+CREATE TABLE Outbox (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Event_Type VARCHAR(64) NOT NULL,
+    Tournament_ID INT NOT NULL DEFAULT 0,
+    House_ID INT NOT NULL DEFAULT 0,
+    Payload MEDIUMTEXT NOT NULL,
+    Created_At TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX (Created_At)
+);
+
+-- Create Outbox_Deliveries table
+CREATE TABLE Outbox_Deliveries (
+    Outbox_ID INT NOT NULL,
+    FOREIGN KEY (Outbox_ID) REFERENCES Outbox(ID),
+    Sink VARCHAR(255) NOT NULL,
+    Delivered_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (Outbox_ID, Sink)
+);
+
+-- Create Audit_Log table, which is only ever appended to
+CREATE TABLE Audit_Log (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Occurred_At TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    Request_ID VARCHAR(64) NOT NULL,
+    Actor VARCHAR(255) NOT NULL,
+    Action VARCHAR(255) NOT NULL,
+    Method VARCHAR(10) NOT NULL,
+    Path VARCHAR(2048) NOT NULL,
+    Entity VARCHAR(64) NOT NULL,
+    Entity_ID VARCHAR(255),
+    Status_Code INT NOT NULL,
+    Before_JSON JSON,
+    After_JSON JSON,
+    Client_IP VARCHAR(64) NOT NULL,
+    INDEX (Entity, Entity_ID),
+    INDEX (Actor),
+    INDEX (Request_ID),
+    INDEX (Occurred_At)
+);
+
+CREATE TRIGGER Audit_Log_No_Update BEFORE UPDATE ON Audit_Log
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Audit_Log is append-only';
+
+CREATE TRIGGER Audit_Log_No_Delete BEFORE DELETE ON Audit_Log
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Audit_Log is append-only';
+
+-- Create Student_House_Points table, the projection of the points each student earned for each house
+CREATE TABLE Student_House_Points (
+    Student_ID INT NOT NULL,
+    FOREIGN KEY (Student_ID) REFERENCES Students(ID),
+    House_ID INT NOT NULL,
+    FOREIGN KEY (House_ID) REFERENCES Houses(ID) ON DELETE CASCADE,
+    Points INT NOT NULL,
+    PRIMARY KEY (Student_ID, House_ID)
+);
+
+-- Create Multipliers table, the time-boxed rules that scale awards
+CREATE TABLE Multipliers (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Multiplier_Name VARCHAR(255) NOT NULL,
+    Factor DECIMAL(6,3) NOT NULL,
+    Tournament_ID INT,
+    FOREIGN KEY (Tournament_ID) REFERENCES Tournaments(ID) ON DELETE CASCADE,
+    House_ID INT,
+    FOREIGN KEY (House_ID) REFERENCES Houses(ID) ON DELETE CASCADE,
+    Category VARCHAR(64),
+    Starts_At TIMESTAMP NOT NULL,
+    Ends_At TIMESTAMP NOT NULL,
+    Created_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    Version INT NOT NULL DEFAULT 1,
+    INDEX (Starts_At, Ends_At),
+    CHECK (Factor > 0),
+    CHECK (Ends_At > Starts_At)
+);
+
+-- Create Student_Achievements table, the achievements each student was granted
+CREATE TABLE Student_Achievements (
+    ID INT AUTO_INCREMENT PRIMARY KEY,
+    Student_ID INT NOT NULL,
+    FOREIGN KEY (Student_ID) REFERENCES Students(ID),
+    Achievement_Key VARCHAR(64) NOT NULL,
+    Achievement_Name VARCHAR(255) NOT NULL,
+    Point_ID INT,
+    FOREIGN KEY (Point_ID) REFERENCES Points(ID) ON DELETE SET NULL,
+    Granted_At TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (Student_ID, Achievement_Key)
+);
+
+-- Totals used to be written directly, so they may not match the records. Keep them by recording the difference
+-- as an opening adjustment, first for each student in their current house, then for each house.
+-- A student's total now counts the tournament of their current house only.
+INSERT INTO Points (Points, Raw_Points, Notes, Student_ID, House_ID, Kind)
+SELECT Students.Points - COALESCE(SUM(Points.Points), 0), Students.Points - COALESCE(SUM(Points.Points), 0),
+    'Opening balance', Students.ID, Students.House_ID, 'adjustment'
+FROM Students
+JOIN Houses AS Current ON Current.ID = Students.House_ID
+LEFT JOIN Houses AS Earned ON Earned.Tournament_ID <=> Current.Tournament_ID
+LEFT JOIN Points ON Points.Student_ID = Students.ID AND Points.House_ID = Earned.ID
+GROUP BY Students.ID, Students.House_ID, Students.Points
+HAVING Students.Points <> COALESCE(SUM(Points.Points), 0);
+
+INSERT INTO Points (Points, Raw_Points, Notes, Student_ID, House_ID, Kind)
+SELECT Houses.House_Points - COALESCE(SUM(Points.Points), 0), Houses.House_Points - COALESCE(SUM(Points.Points), 0),
+    'Opening balance', NULL, Houses.ID, 'adjustment'
+FROM Houses
+LEFT JOIN Points ON Points.House_ID = Houses.ID
+GROUP BY Houses.ID, Houses.House_Points
+HAVING Houses.House_Points <> COALESCE(SUM(Points.Points), 0);
+
+-- Points is an immutable ledger from here on
+CREATE TRIGGER Points_No_Update BEFORE UPDATE ON Points
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Points is append-only';
+
+CREATE TRIGGER Points_No_Delete BEFORE DELETE ON Points
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Points is append-only';
+
+-- Project the existing ledger
+INSERT INTO Student_House_Points (Student_ID, House_ID, Points)
+SELECT Student_ID, House_ID, SUM(Points)
+FROM Points
+WHERE Student_ID IS NOT NULL
+GROUP BY Student_ID, House_ID;
+
+UPDATE Houses
+LEFT JOIN (
+    SELECT House_ID, SUM(Points) AS Total
+    FROM Points
+    GROUP BY House_ID
+) AS Totals ON Totals.House_ID = Houses.ID
+SET Houses.House_Points = COALESCE(Totals.Total, 0);
+
+-- Total each student's points for the tournament of their current house
+UPDATE Students
+LEFT JOIN Houses AS Current ON Current.ID = Students.House_ID
+LEFT JOIN (
+    SELECT Student_House_Points.Student_ID, Houses.Tournament_ID, SUM(Student_House_Points.Points) AS Total
+    FROM Student_House_Points
+    JOIN Houses ON Houses.ID = Student_House_Points.House_ID
+    GROUP BY Student_House_Points.Student_ID, Houses.Tournament_ID
+) AS Totals ON Totals.Student_ID = Students.ID AND Totals.Tournament_ID <=> Current.Tournament_ID
+SET Students.Points = COALESCE(Totals.Total, 0);
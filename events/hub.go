@@ -0,0 +1,153 @@
+// Package events fans out changes to the house-cup leaderboards to live subscribers,
+// such as Server-Sent Events and WebSocket clients, without a database connection per subscriber.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published by the application.
+const (
+	// Award announces a new points record.
+	Award = "award"
+	// Reversal announces a points record that reverses an earlier one.
+	Reversal = "reversal"
+	// Transfer announces a student moving between houses.
+	Transfer = "transfer"
+	// HouseTotal announces the new total of a house after any change to its points.
+	HouseTotal = "house_total"
+	// StudentDeleted announces a deleted student.
+	StudentDeleted = "student_deleted"
+	// TournamentEnded announces a tournament that was given its end date, with its final standings.
+	TournamentEnded = "tournament_ended"
+	// AchievementGranted announces an achievement a student earned with an award.
+	AchievementGranted = "achievement_granted"
+)
+
+// Sizes of the replay buffer and of each subscriber's queue.
+const (
+	historySize = 1024
+	queueSize   = 64
+)
+
+// Event is a change published to subscribers. IDs increase by one with every event published by a Hub.
+type Event struct {
+	ID            uint64      `json:"id"`
+	Type          string      `json:"type"`
+	Tournament_ID int64       `json:"tournament_id"`
+	House_ID      int64       `json:"house_id"`
+	Data          interface{} `json:"data"`
+	Occurred_At   string      `json:"occurred_at"`
+}
+
+// Filter selects the events a subscriber receives. Zero fields match everything.
+type Filter struct {
+	Tournament_ID int64
+	House_ID      int64
+}
+
+func (f Filter) matches(e Event) bool {
+	return (f.Tournament_ID == 0 || f.Tournament_ID == e.Tournament_ID) &&
+		(f.House_ID == 0 || f.House_ID == e.House_ID)
+}
+
+// Hub keeps the most recent events for resuming subscribers and fans every new event out to them.
+type Hub struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []Event
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives the events matching its filter on Events until it is closed.
+// A subscriber that falls too far behind has its channel closed and should resume from its last event ID.
+// Start is the ID of the last event published before it subscribed.
+type Subscription struct {
+	Events <-chan Event
+	Start  uint64
+	events chan Event
+	filter Filter
+	hub    *Hub
+}
+
+// Default is the hub shared by the handlers of the application.
+var Default = NewHub()
+
+// NewHub returns an empty hub.
+func NewHub() *Hub {
+	return &Hub{subscribers: map[*Subscription]struct{}{}}
+}
+
+// Publish assigns IDs to events and delivers them to every matching subscriber.
+func (h *Hub) Publish(events ...Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, event := range events {
+		h.lastID++
+		event.ID = h.lastID
+		if event.Occurred_At == "" {
+			event.Occurred_At = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+
+		h.history = append(h.history, event)
+		if len(h.history) > historySize {
+			h.history = h.history[len(h.history)-historySize:]
+		}
+
+		for sub := range h.subscribers {
+			if !sub.filter.matches(event) {
+				continue
+			}
+			select {
+			case sub.events <- event:
+			default:
+				// Never block publishers on a slow subscriber
+				h.drop(sub)
+			}
+		}
+	}
+}
+
+// Subscribe registers a subscriber for the events matching filter.
+// With a lastEventID it also returns the matching events published since then and reports whether
+// that replay is complete; when it is not, events were missed and the subscriber should reload its state.
+func (h *Hub) Subscribe(filter Filter, lastEventID uint64) (sub *Subscription, missed []Event, complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	complete = true
+	if lastEventID > 0 {
+		oldest := h.lastID + 1
+		if len(h.history) > 0 {
+			oldest = h.history[0].ID
+		}
+		// IDs beyond the last one were handed out before a restart
+		complete = lastEventID+1 >= oldest && lastEventID <= h.lastID
+		for _, event := range h.history {
+			if event.ID > lastEventID && filter.matches(event) {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	events := make(chan Event, queueSize)
+	sub = &Subscription{Events: events, Start: h.lastID, events: events, filter: filter, hub: h}
+	h.subscribers[sub] = struct{}{}
+	return sub, missed, complete
+}
+
+// Close unregisters the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.drop(s)
+}
+
+func (h *Hub) drop(sub *Subscription) {
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,198 @@
+// Package ledger keeps the Points table as the single source of truth of the house-cup points.
+// Points records are immutable events: awards, reversals of earlier records, transfers of points
+// between houses and adjustments. House totals, student totals and the points each student earned
+// for each house are projections of those events, updated in the transaction that appends them
+// and rebuilt from scratch by replaying the whole ledger.
+package ledger
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gambinish/house-cup/models"
+)
+
+// Kinds of points records.
+const (
+	// Award is points given to a house, and possibly one of its students.
+	Award = "award"
+	// Reversal cancels an earlier record; it carries the opposite amount and points at the record in Reverses_ID.
+	Reversal = "reversal"
+	// Transfer moves a student's points from one house to another, as a pair of records of opposite amounts.
+	Transfer = "transfer"
+	// Adjustment corrects totals outside of an award, such as points reset on a transfer or taken from a deleted student.
+	Adjustment = "adjustment"
+)
+
+// Kinds lists every kind of points record.
+var Kinds = []string{Award, Reversal, Transfer, Adjustment}
+
+// batchSize is how many records a replay reads and applies at a time.
+const batchSize = 1000
+
+// pointColumns are the columns a points record is read from, in the order scanPoints expects them.
+const pointColumns = "ID, Points, COALESCE(Notes, ''), Student_ID, House_ID, Created_At, Kind, Reverses_ID, Raw_Points, Category, Multiplier_IDs"
+
+var (
+	// ErrAlreadyReversed reports a record that already has a reversal.
+	ErrAlreadyReversed = errors.New("points record is already reversed")
+	// ErrIrreversible reports an attempt to reverse a reversal; award the points again instead.
+	ErrIrreversible = errors.New("a reversal cannot be reversed")
+)
+
+// KnownKind reports whether kind is one of Kinds.
+func KnownKind(kind string) bool {
+	for _, known := range Kinds {
+		if known == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Append adds points records to the ledger within tx and applies them to every projection.
+// A record without a kind is an award, one without a raw amount was not multiplied and one
+// without a creation time is created now. Append applies no multipliers; AppendAwards does.
+// It returns the records with their new IDs.
+func Append(tx *sql.Tx, points ...models.Point) ([]models.Point, error) {
+	appended := make([]models.Point, len(points))
+	for i, point := range points {
+		if point.Kind == "" {
+			point.Kind = Award
+		}
+		if point.Raw_Points == 0 {
+			point.Raw_Points = point.Points
+		}
+		result, err := tx.Exec(`INSERT INTO Points (Points, Notes, Student_ID, House_ID, Created_At, Kind, Reverses_ID, Raw_Points, Category, Multiplier_IDs)
+								VALUES (?, ?, ?, ?, COALESCE(NULLIF(?, ''), CURRENT_TIMESTAMP), ?, ?, ?, ?, ?)`,
+			point.Points, point.Notes, point.Student_ID, point.House_ID, point.Created_At, point.Kind, point.Reverses_ID,
+			point.Raw_Points, point.Category, point.Multiplier_IDs)
+		if err != nil {
+			return nil, err
+		}
+		if point.ID, err = result.LastInsertId(); err != nil {
+			return nil, err
+		}
+		appended[i] = point
+	}
+
+	if err := apply(tx, Projections, appended); err != nil {
+		return nil, err
+	}
+	return appended, nil
+}
+
+// Reverse appends within tx the reversal of the record identified by id, with the given notes.
+// The reversal cancels the effective amount exactly and carries the record's raw amount, category and multipliers negated.
+// It returns sql.ErrNoRows when there is no such record, ErrIrreversible for a reversal
+// and ErrAlreadyReversed when the record was reversed before.
+func Reverse(tx *sql.Tx, id int64, notes string) (models.Point, error) {
+	rows, err := tx.Query("SELECT "+pointColumns+" FROM Points WHERE ID = ? FOR UPDATE", id)
+	if err != nil {
+		return models.Point{}, err
+	}
+	points, err := scanPoints(rows)
+	if err != nil {
+		return models.Point{}, err
+	}
+	if len(points) == 0 {
+		return models.Point{}, sql.ErrNoRows
+	}
+	original := points[0]
+	if original.Kind == Reversal {
+		return models.Point{}, ErrIrreversible
+	}
+
+	var reversalID int64
+	err = tx.QueryRow("SELECT ID FROM Points WHERE Reverses_ID = ?", id).Scan(&reversalID)
+	if err == nil {
+		return models.Point{}, ErrAlreadyReversed
+	}
+	if err != sql.ErrNoRows {
+		return models.Point{}, err
+	}
+
+	reversal := models.Point{
+		Points:         -original.Points,
+		Notes:          notes,
+		Student_ID:     original.Student_ID,
+		House_ID:       original.House_ID,
+		Kind:           Reversal,
+		Reverses_ID:    &original.ID,
+		Raw_Points:     -original.Raw_Points,
+		Category:       original.Category,
+		Multiplier_IDs: original.Multiplier_IDs,
+	}
+	appended, err := Append(tx, reversal)
+	if err != nil {
+		return models.Point{}, err
+	}
+	return appended[0], nil
+}
+
+// Rebuild resets the given projections, or every projection when none are given, and replays
+// the whole ledger into them within tx, oldest record first. It returns how many records were replayed.
+// The ledger is share-locked until tx ends, so records appended meanwhile wait instead of being missed by the replay.
+func Rebuild(tx *sql.Tx, projections ...Projection) (int64, error) {
+	if len(projections) == 0 {
+		projections = Projections
+	}
+	// Lock before resetting, so an append in flight is fully counted before the projections are touched
+	var records int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM Points FOR SHARE").Scan(&records); err != nil {
+		return 0, err
+	}
+	for _, projection := range projections {
+		if err := projection.Reset(tx); err != nil {
+			return 0, err
+		}
+	}
+
+	var replayed, lastID int64
+	for {
+		rows, err := tx.Query("SELECT "+pointColumns+" FROM Points WHERE ID > ? ORDER BY ID LIMIT ?", lastID, batchSize)
+		if err != nil {
+			return replayed, err
+		}
+		points, err := scanPoints(rows)
+		if err != nil {
+			return replayed, err
+		}
+		if len(points) == 0 {
+			return replayed, nil
+		}
+		if err := apply(tx, projections, points); err != nil {
+			return replayed, err
+		}
+		replayed += int64(len(points))
+		lastID = points[len(points)-1].ID
+	}
+}
+
+// apply applies records to projections in order.
+func apply(tx *sql.Tx, projections []Projection, points []models.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	for _, projection := range projections {
+		if err := projection.Apply(tx, points); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanPoints reads every record selected with pointColumns and closes rows.
+func scanPoints(rows *sql.Rows) ([]models.Point, error) {
+	defer rows.Close()
+
+	var points []models.Point
+	for rows.Next() {
+		var point models.Point
+		if err := rows.Scan(&point.ID, &point.Points, &point.Notes, &point.Student_ID, &point.House_ID, &point.Created_At, &point.Kind, &point.Reverses_ID, &point.Raw_Points, &point.Category, &point.Multiplier_IDs); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
@@ -0,0 +1,116 @@
+package ledger
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/gambinish/house-cup/models"
+)
+
+// multiplier is a rule in effect for an award, with its factor as stored, such as "1.500".
+type multiplier struct {
+	id     int64
+	factor string
+}
+
+// AppendAwards appends award records to the ledger within tx after applying the multipliers in effect for each of them.
+// A multiplier is in effect when the current time is within its Starts_At and Ends_At and every scope it sets,
+// its tournament, house and category, matches the award. The factors of all multipliers in effect are multiplied
+// together. Each record keeps the amount it was given as its raw amount and gets the multiplied amount, rounded
+// half away from zero, as its effective amount, along with the IDs of the multipliers applied.
+// It returns the records with their new IDs.
+func AppendAwards(tx *sql.Tx, points ...models.Point) ([]models.Point, error) {
+	cache := map[string][]multiplier{}
+	for i := range points {
+		point := &points[i]
+		point.Kind = Award
+
+		category := ""
+		if point.Category != nil {
+			category = *point.Category
+		}
+		key := strconv.FormatInt(point.House_ID, 10) + "/" + category
+		multipliers, ok := cache[key]
+		if !ok {
+			var err error
+			if multipliers, err = multipliersInEffect(tx, point.House_ID, point.Category); err != nil {
+				return nil, err
+			}
+			cache[key] = multipliers
+		}
+
+		point.Raw_Points = point.Points
+		point.Multiplier_IDs = nil
+		if len(multipliers) == 0 {
+			continue
+		}
+		effective, err := multiply(point.Points, multipliers)
+		if err != nil {
+			return nil, err
+		}
+		point.Points = effective
+		ids := make([]string, len(multipliers))
+		for j, m := range multipliers {
+			ids[j] = strconv.FormatInt(m.id, 10)
+		}
+		joined := strings.Join(ids, ",")
+		point.Multiplier_IDs = &joined
+	}
+	return Append(tx, points...)
+}
+
+// multipliersInEffect returns the multipliers in effect now for an award to a house in a category, oldest first.
+func multipliersInEffect(tx *sql.Tx, houseID int64, category *string) ([]multiplier, error) {
+	rows, err := tx.Query(`SELECT Multipliers.ID, Multipliers.Factor
+							FROM Multipliers
+							JOIN Houses ON Houses.ID = ?
+							WHERE Multipliers.Starts_At <= CURRENT_TIMESTAMP AND Multipliers.Ends_At > CURRENT_TIMESTAMP
+								AND (Multipliers.Tournament_ID IS NULL OR Multipliers.Tournament_ID = Houses.Tournament_ID)
+								AND (Multipliers.House_ID IS NULL OR Multipliers.House_ID = Houses.ID)
+								AND (Multipliers.Category IS NULL OR Multipliers.Category = ?)
+							ORDER BY Multipliers.ID`, houseID, category)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var multipliers []multiplier
+	for rows.Next() {
+		var m multiplier
+		if err := rows.Scan(&m.id, &m.factor); err != nil {
+			return nil, err
+		}
+		multipliers = append(multipliers, m)
+	}
+	return multipliers, rows.Err()
+}
+
+// multiply returns raw times the product of the factors of multipliers, rounded half away from zero.
+// Factors are exact decimals, so the result does not depend on floating point rounding.
+func multiply(raw int64, multipliers []multiplier) (int64, error) {
+	product := new(big.Rat).SetInt64(raw)
+	for _, m := range multipliers {
+		factor, ok := new(big.Rat).SetString(m.factor)
+		if !ok {
+			return 0, fmt.Errorf("multiplier %d: invalid factor %q", m.id, m.factor)
+		}
+		product.Mul(product, factor)
+	}
+
+	// Round half away from zero: add half a unit to the magnitude and truncate
+	numerator := new(big.Int).Abs(product.Num())
+	denominator := product.Denom()
+	numerator.Mul(numerator, big.NewInt(2))
+	numerator.Add(numerator, denominator)
+	numerator.Quo(numerator, new(big.Int).Mul(denominator, big.NewInt(2)))
+	if product.Sign() < 0 {
+		numerator.Neg(numerator)
+	}
+	if !numerator.IsInt64() {
+		return 0, fmt.Errorf("multiplied points overflow")
+	}
+	return numerator.Int64(), nil
+}
@@ -0,0 +1,58 @@
+package ledger
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMultiply(t *testing.T) {
+	tests := []struct {
+		raw     int64
+		factors []string
+		want    int64
+	}{
+		{10, []string{"2.000"}, 20},
+		{10, []string{"1.500"}, 15},
+		// Halves round away from zero, in both directions
+		{5, []string{"1.500"}, 8},
+		{-5, []string{"1.500"}, -8},
+		{3, []string{"0.500"}, 2},
+		{-3, []string{"0.500"}, -2},
+		// Anything short of a half rounds towards zero
+		{7, []string{"1.070"}, 7},
+		{-7, []string{"1.070"}, -7},
+		{7, []string{"1.072"}, 8},
+		// Stacked factors are multiplied exactly before rounding once
+		{10, []string{"1.500", "2.000"}, 30},
+		{3, []string{"1.100", "1.100"}, 4},
+		{1, []string{"0.500", "0.500", "0.500"}, 0},
+		{5, []string{"0.333", "3.000"}, 5},
+		{0, []string{"999.999"}, 0},
+		{100, []string{"0.001"}, 0},
+		{500, []string{"0.001"}, 1},
+		{-500, []string{"0.001"}, -1},
+	}
+	for _, test := range tests {
+		multipliers := make([]multiplier, len(test.factors))
+		for i, factor := range test.factors {
+			multipliers[i] = multiplier{id: int64(i + 1), factor: factor}
+		}
+		got, err := multiply(test.raw, multipliers)
+		if err != nil {
+			t.Errorf("multiply(%d, %v): %v", test.raw, test.factors, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("multiply(%d, %v) = %d, want %d", test.raw, test.factors, got, test.want)
+		}
+	}
+}
+
+func TestMultiplyErrors(t *testing.T) {
+	if _, err := multiply(10, []multiplier{{id: 1, factor: "not a number"}}); err == nil {
+		t.Error("multiply accepted an invalid factor")
+	}
+	if _, err := multiply(math.MaxInt64, []multiplier{{id: 1, factor: "2.000"}}); err == nil {
+		t.Error("multiply accepted a result that overflows")
+	}
+}
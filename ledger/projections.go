@@ -0,0 +1,178 @@
+package ledger
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/gambinish/house-cup/models"
+)
+
+// Projection is state derived from the ledger. Apply must be additive, so that applying a record
+// with its amount negated takes it back off, or recompute from projections applied before it;
+// Reset must return the state to an empty ledger.
+type Projection interface {
+	// Name identifies the projection, for example when rebuilding it.
+	Name() string
+	// Reset clears the projection before a replay.
+	Reset(tx *sql.Tx) error
+	// Apply adds records to the projection.
+	Apply(tx *sql.Tx, points []models.Point) error
+}
+
+// The projections of the ledger.
+var (
+	// HouseTotals keeps Houses.House_Points at the sum of each house's records.
+	HouseTotals Projection = houseTotals{}
+	// StudentTotals keeps Students.Points at the sum of each student's records for the houses of the tournament
+	// of their current house, so a student starts every tournament on zero. It is recomputed from StudentHousePoints;
+	// call RefreshStudentTotals whenever a student's current house moves to another tournament.
+	StudentTotals Projection = studentTotals{}
+	// StudentHousePoints keeps Student_House_Points at the sum of each student's records for each house,
+	// which the tournament leaderboards and standings are read from.
+	StudentHousePoints Projection = studentHousePoints{}
+)
+
+// Projections lists the projections that Append keeps up to date, in the order they are applied.
+var Projections = []Projection{HouseTotals, StudentHousePoints, StudentTotals}
+
+// Lookup returns the projection called name, or nil when there is none.
+func Lookup(name string) Projection {
+	for _, projection := range Projections {
+		if projection.Name() == name {
+			return projection
+		}
+	}
+	return nil
+}
+
+// sums adds up the amounts of records by key, leaving out records without a key,
+// and returns the keys with a non-zero sum in ascending order, so rows are always locked in the same order.
+func sums(points []models.Point, key func(models.Point) (int64, bool)) ([]int64, map[int64]int64) {
+	totals := map[int64]int64{}
+	for _, point := range points {
+		if k, ok := key(point); ok {
+			totals[k] += point.Points
+		}
+	}
+	var keys []int64
+	for k, total := range totals {
+		if total != 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, totals
+}
+
+type houseTotals struct{}
+
+func (houseTotals) Name() string { return "house_totals" }
+
+func (houseTotals) Reset(tx *sql.Tx) error {
+	_, err := tx.Exec("UPDATE Houses SET House_Points = 0 WHERE House_Points <> 0")
+	return err
+}
+
+func (houseTotals) Apply(tx *sql.Tx, points []models.Point) error {
+	houseIDs, totals := sums(points, func(point models.Point) (int64, bool) { return point.House_ID, true })
+	for _, houseID := range houseIDs {
+		_, err := tx.Exec("UPDATE Houses SET House_Points = House_Points + ?, Version = Version + 1 WHERE ID = ?", totals[houseID], houseID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type studentTotals struct{}
+
+func (studentTotals) Name() string { return "student_totals" }
+
+func (studentTotals) Reset(tx *sql.Tx) error {
+	_, err := tx.Exec("UPDATE Students SET Points = 0 WHERE Points <> 0")
+	return err
+}
+
+func (studentTotals) Apply(tx *sql.Tx, points []models.Point) error {
+	studentIDs, _ := sums(points, func(point models.Point) (int64, bool) {
+		if point.Student_ID == nil {
+			return 0, false
+		}
+		return *point.Student_ID, true
+	})
+	return RefreshStudentTotals(tx, studentIDs...)
+}
+
+// Execer is satisfied by both *sql.DB and *sql.Tx.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// RefreshStudentTotals recomputes Students.Points for the given students from Student_House_Points:
+// the points each earned for the houses of the tournament of their current house, or zero without a house.
+func RefreshStudentTotals(e Execer, studentIDs ...int64) error {
+	if len(studentIDs) == 0 {
+		return nil
+	}
+	placeholders := "?" + strings.Repeat(", ?", len(studentIDs)-1)
+	args := make([]interface{}, 0, 2*len(studentIDs))
+	for i := 0; i < 2; i++ {
+		for _, studentID := range studentIDs {
+			args = append(args, studentID)
+		}
+	}
+	_, err := e.Exec(`UPDATE Students
+						LEFT JOIN (
+							SELECT Student_House_Points.Student_ID, SUM(Student_House_Points.Points) AS Total
+							FROM Student_House_Points
+							JOIN Houses ON Houses.ID = Student_House_Points.House_ID
+							JOIN Students AS Member ON Member.ID = Student_House_Points.Student_ID
+							JOIN Houses AS Current ON Current.ID = Member.House_ID
+							WHERE Houses.Tournament_ID <=> Current.Tournament_ID AND Student_House_Points.Student_ID IN (`+placeholders+`)
+							GROUP BY Student_House_Points.Student_ID
+						) AS Totals ON Totals.Student_ID = Students.ID
+						SET Students.Points = COALESCE(Totals.Total, 0), Students.Version = Students.Version + 1
+						WHERE Students.ID IN (`+placeholders+`) AND Students.Points <> COALESCE(Totals.Total, 0)`, args...)
+	return err
+}
+
+type studentHousePoints struct{}
+
+func (studentHousePoints) Name() string { return "student_house_points" }
+
+func (studentHousePoints) Reset(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM Student_House_Points")
+	return err
+}
+
+func (studentHousePoints) Apply(tx *sql.Tx, points []models.Point) error {
+	type key struct{ studentID, houseID int64 }
+	totals := map[key]int64{}
+	var keys []key
+	for _, point := range points {
+		if point.Student_ID == nil {
+			continue
+		}
+		k := key{*point.Student_ID, point.House_ID}
+		if _, ok := totals[k]; !ok {
+			keys = append(keys, k)
+		}
+		totals[k] += point.Points
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].studentID != keys[j].studentID {
+			return keys[i].studentID < keys[j].studentID
+		}
+		return keys[i].houseID < keys[j].houseID
+	})
+
+	for _, k := range keys {
+		_, err := tx.Exec(`INSERT INTO Student_House_Points (Student_ID, House_ID, Points) VALUES (?, ?, ?)
+							ON DUPLICATE KEY UPDATE Points = Points + VALUES(Points)`, k.studentID, k.houseID, totals[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
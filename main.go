@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 
+	"github.com/gambinish/house-cup/achievements"
+	"github.com/gambinish/house-cup/config"
 	"github.com/gambinish/house-cup/controllers"
+	"github.com/gambinish/house-cup/events"
+	"github.com/gambinish/house-cup/middleware"
+	"github.com/gambinish/house-cup/outbox"
+	"github.com/gambinish/house-cup/webhooks"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
@@ -34,42 +41,178 @@ func main() {
 
 	// config.ConnectToDB()
 
+	// Load the achievement rules students earn badges with
+	achievementsFile := os.Getenv("ACHIEVEMENTS_FILE")
+	if achievementsFile == "" {
+		achievementsFile = "achievements.json"
+	}
+	if err := achievements.Default.Load(achievementsFile); err != nil {
+		log.Fatal(err)
+	}
+
+	// Chat commands cannot be verified, and are refused, without a signing secret or token
+	if !controllers.CommandsEnabled() {
+		log.Print("chat commands are disabled until SLACK_SIGNING_SECRET or SLASH_COMMAND_TOKEN is set")
+	}
+
 	router := gin.Default()
+	router.Use(middleware.Audit())
 	router.GET("/", sanityCheck)
 
 	log.Print(os.Getenv("API_HOST"))
+	registerV1Routes(router.Group("/api/v1"))
+	registerLegacyRoutes(router)
+
+	// Relay outbox entries to their sinks and send queued webhook deliveries in the background
+	if err := outbox.Default.RegisterSinks(events.Default, webhooks.Default); err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		db := config.ConnectToDB()
+		go webhooks.Default.Run(context.Background(), db)
+		outbox.Default.Run(context.Background(), db)
+	}()
+
+	apiHost := os.Getenv("API_HOST")
+	apiPort := os.Getenv("API_PORT")
+	apiAddr := apiHost + ":" + apiPort
+
+	log.Print("API ADDRESS: ", apiAddr)
+	router.Run(apiAddr)
+}
+
+// registerV1Routes mounts the versioned API, where resources are nested under their parent.
+// Gin requires every wildcard at the same position to share a name, so a nested ":id"
+// always refers to the parent resource named right before it.
+func registerV1Routes(v1 *gin.RouterGroup) {
+	idempotent := middleware.Idempotent()
+
 	// tournament routes
-	router.GET("/tournaments", controllers.GetTournaments)
-	router.GET("/tournaments/:id", controllers.GetTournamentById)
-	router.POST("/tournaments", controllers.PostTournament)
-	router.PUT("/tournaments/:id", controllers.UpdateTournamentById)
+	v1.GET("/tournaments", controllers.GetTournaments)
+	v1.POST("/tournaments", idempotent, controllers.PostTournament)
+	v1.POST("/tournaments/restore", idempotent, controllers.RestoreTournament)
+	v1.GET("/tournaments/:id", controllers.GetTournamentById)
+	v1.PUT("/tournaments/:id", controllers.UpdateTournamentById)
+	v1.PATCH("/tournaments/:id", controllers.PatchTournamentById)
+	v1.DELETE("/tournaments/:id", controllers.DeleteTournamentById)
+	v1.GET("/tournaments/:id/houses", controllers.GetHousesByTournamentId)
+	v1.POST("/tournaments/:id/houses", idempotent, controllers.CreateHouseByTournamentId)
+	v1.GET("/tournaments/:id/students", controllers.GetStudentsByTournamentId)
+	v1.POST("/tournaments/:id/students/import", controllers.ImportStudentsByTournamentId)
+	v1.POST("/tournaments/:id/students/oneroster", controllers.ImportOneRosterByTournamentId)
+	v1.POST("/tournaments/:id/assignments", controllers.AssignStudentsByTournamentId)
+	v1.GET("/tournaments/:id/backup", controllers.BackupTournamentById)
+	v1.GET("/tournaments/:id/stream", controllers.StreamTournamentById)
+	v1.POST("/tournaments/:id/clone", idempotent, controllers.CloneTournamentById)
 
 	// houses routes
-	router.GET("/houses", controllers.GetHouses)
-	router.GET("/houses/:id", controllers.GetHousesByTournamentId)
-	router.POST("/houses/:id", controllers.PostHouseByTournamentId)
-	router.PUT("/houses/:id", controllers.UpdateHouseById)
+	v1.GET("/houses", controllers.GetHouses)
+	v1.GET("/houses/:id", controllers.GetHouseById)
+	v1.PUT("/houses/:id", controllers.UpdateHouseById)
+	v1.PATCH("/houses/:id", controllers.PatchHouseById)
+	v1.DELETE("/houses/:id", controllers.DeleteHouseById)
+	v1.GET("/houses/:id/students", controllers.GetStudentsByHouseId)
+	v1.POST("/houses/:id/students", idempotent, controllers.PostStudentByHouseId)
+	v1.GET("/houses/:id/points", controllers.GetPointsByHouseId)
 
 	// student routes
-	router.GET("/students", controllers.GetStudents)
-	router.GET("/students/:id", controllers.GetStudentById)
-	router.GET("/students/tournament/:id", controllers.GetStudentsByTournamentId)
-	router.GET("/students/house/:id", controllers.GetStudentsByHouseId)
-	router.PUT("/students/:id", controllers.UpdateStudentById)
-	router.POST("/student", controllers.PostStudent)
-	router.POST("/students", controllers.PostStudents)
-	router.DELETE("/students/:id", controllers.DeleteStudentById)
+	v1.GET("/students", controllers.GetStudents)
+	v1.GET("/students/unassigned", controllers.GetUnassignedStudents)
+	v1.GET("/students/external/:external_id", controllers.GetStudentByExternalId)
+	v1.PUT("/students/external/:external_id", controllers.UpsertStudentByExternalId)
+	v1.POST("/students/bulk", idempotent, controllers.PostStudents)
+	v1.GET("/students/:id", controllers.GetStudentById)
+	v1.PUT("/students/:id", controllers.UpdateStudentById)
+	v1.PATCH("/students/:id", controllers.PatchStudentById)
+	v1.DELETE("/students/:id", controllers.DeleteStudentById)
+	v1.POST("/students/:id/restore", controllers.RestoreStudentById)
+	v1.GET("/students/:id/points", controllers.GetPointsByStudentId)
+	v1.POST("/students/:id/points", idempotent, controllers.PostPointsByStudentId)
+	v1.GET("/students/:id/transfers", controllers.GetTransfersByStudentId)
+	v1.POST("/students/:id/transfers", controllers.TransferStudentById)
+	v1.GET("/students/:id/enrollments", controllers.GetEnrollmentsByStudentId)
+	v1.GET("/students/:id/badges", controllers.GetBadgesByStudentId)
+	v1.POST("/students/:id/enrollments", idempotent, controllers.PostEnrollmentByStudentId)
 
 	// points routes
-	router.GET("/points", controllers.GetPoints)
-	router.GET("/points/:id", controllers.GetPointsByStudentId)
-	router.GET("/points/house/:id", controllers.GetPointsByHouseId)
-	router.POST("/points", controllers.PostPoints)
+	v1.GET("/points", controllers.GetPoints)
+	v1.POST("/points", idempotent, controllers.PostPoints)
+	v1.POST("/points/bulk", idempotent, controllers.PostBulkPoints)
+	v1.GET("/points/:id", controllers.GetPointById)
+	v1.DELETE("/points/:id", controllers.DeletePointById)
 
-	apiHost := os.Getenv("API_HOST")
-	apiPort := os.Getenv("API_PORT")
-	apiAddr := apiHost + ":" + apiPort
+	// badge routes
+	v1.GET("/badges", controllers.GetBadges)
 
-	log.Print("API ADDRESS: ", apiAddr)
-	router.Run(apiAddr)
+	// chat command routes
+	v1.POST("/commands/award", controllers.AwardCommand)
+
+	// live routes
+	v1.GET("/ws", controllers.ServeSocket)
+
+	// webhook routes, admin only: deliveries carry student names and are sent to the registered URLs
+	v1.GET("/webhooks", middleware.Admin(), controllers.GetWebhooks)
+	v1.POST("/webhooks", middleware.Admin(), middleware.Idempotent("secret"), controllers.PostWebhook)
+	v1.GET("/webhooks/:id", middleware.Admin(), controllers.GetWebhookById)
+	v1.PATCH("/webhooks/:id", middleware.Admin(), controllers.PatchWebhookById)
+	v1.DELETE("/webhooks/:id", middleware.Admin(), controllers.DeleteWebhookById)
+	v1.GET("/webhooks/:id/deliveries", middleware.Admin(), controllers.GetDeliveriesByWebhookId)
+	v1.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", middleware.Admin(), controllers.RedeliverWebhookDelivery)
+
+	// multiplier routes
+	v1.GET("/multipliers", controllers.GetMultipliers)
+	v1.POST("/multipliers", idempotent, controllers.PostMultiplier)
+	v1.GET("/multipliers/:id", controllers.GetMultiplierById)
+	v1.PATCH("/multipliers/:id", controllers.PatchMultiplierById)
+	v1.DELETE("/multipliers/:id", controllers.DeleteMultiplierById)
+
+	// admin routes
+	v1.GET("/audit", middleware.Admin(), controllers.GetAuditLog)
+	v1.GET("/projections", middleware.Admin(), controllers.GetProjections)
+	v1.POST("/projections/rebuild", middleware.Admin(), controllers.RebuildProjections)
+
+	// export routes
+	v1.GET("/exports/points", controllers.ExportPoints)
+	v1.GET("/exports/standings/houses", controllers.ExportHouseStandings)
+	v1.GET("/exports/standings/students", controllers.ExportStudentStandings)
+}
+
+// registerLegacyRoutes keeps the original unversioned routes reachable until clients migrate.
+// Every route answers with Deprecation and Link headers naming its /api/v1 successor.
+// Legacy paths keep the handlers they had, even where /api/v1 gives the same path another meaning:
+// GET /houses/:id lists a tournament's houses and GET /points/:id a student's points.
+func registerLegacyRoutes(router *gin.Engine) {
+	deprecated := middleware.Deprecated
+	idempotent := middleware.Idempotent()
+
+	// tournament routes
+	router.GET("/tournaments", deprecated("/api/v1/tournaments"), controllers.GetTournaments)
+	router.GET("/tournaments/:id", deprecated("/api/v1/tournaments/:id"), controllers.GetTournamentById)
+	router.POST("/tournaments", deprecated("/api/v1/tournaments"), idempotent, controllers.PostTournament)
+	router.PUT("/tournaments/:id", deprecated("/api/v1/tournaments/:id"), controllers.UpdateTournamentById)
+	router.DELETE("/tournaments/:id", deprecated("/api/v1/tournaments/:id"), controllers.DeleteTournamentById)
+
+	// houses routes
+	router.GET("/houses", deprecated("/api/v1/houses"), controllers.GetHouses)
+	router.GET("/houses/:id", deprecated("/api/v1/tournaments/:id/houses"), controllers.GetHousesByTournamentId)
+	router.POST("/houses/:id", deprecated("/api/v1/tournaments/:id/houses"), idempotent, controllers.PostHouseByTournamentId)
+	router.PUT("/houses/:id", deprecated("/api/v1/houses/:id"), controllers.UpdateHouseById)
+	router.DELETE("/houses/:id", deprecated("/api/v1/houses/:id"), controllers.DeleteHouseById)
+
+	// student routes
+	router.GET("/students", deprecated("/api/v1/students"), controllers.GetStudents)
+	router.GET("/students/:id", deprecated("/api/v1/students/:id"), controllers.GetStudentById)
+	router.GET("/students/tournament/:id", deprecated("/api/v1/tournaments/:id/students"), controllers.GetStudentsByTournamentId)
+	router.GET("/students/house/:id", deprecated("/api/v1/houses/:id/students"), controllers.GetStudentsByHouseId)
+	router.PUT("/students/:id", deprecated("/api/v1/students/:id"), controllers.UpdateStudentById)
+	router.POST("/student", deprecated("/api/v1/houses/:id/students"), idempotent, controllers.PostStudent)
+	router.POST("/students", deprecated("/api/v1/students/bulk"), idempotent, controllers.PostStudents)
+	router.DELETE("/students/:id", deprecated("/api/v1/students/:id"), controllers.DeleteStudentById)
+
+	// points routes
+	router.GET("/points", deprecated("/api/v1/points"), controllers.GetPoints)
+	router.GET("/points/:id", deprecated("/api/v1/students/:id/points"), controllers.GetPointsByStudentId)
+	router.GET("/points/house/:id", deprecated("/api/v1/houses/:id/points"), controllers.GetPointsByHouseId)
+	router.POST("/points", deprecated("/api/v1/points"), idempotent, controllers.PostPoints)
+	router.DELETE("/points/:id", deprecated("/api/v1/points/:id"), controllers.DeletePointById)
 }
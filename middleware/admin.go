@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gambinish/house-cup/audit"
+	"github.com/gin-gonic/gin"
+)
+
+// Admin restricts a route to administrators, who authenticate with the bearer token set in ADMIN_TOKEN.
+// While ADMIN_TOKEN is not set the route is closed to everyone.
+func Admin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin: admin access is not configured"})
+			return
+		}
+
+		presented := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="house-cup admin"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin: a valid admin bearer token is required"})
+			return
+		}
+		c.Set(audit.ActorKey, "admin")
+		c.Next()
+	}
+}
@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gambinish/house-cup/audit"
+	"github.com/gambinish/house-cup/config"
+	"github.com/gin-gonic/gin"
+)
+
+// auditMaxResponse is the largest response body kept as the after snapshot of a create.
+const auditMaxResponse = 64 * 1024
+
+// auditTables maps the first segment of a route to the table of the entity it addresses.
+var auditTables = map[string]string{
+	"tournaments": "Tournaments",
+	"houses":      "Houses",
+	"students":    "Students",
+	"points":      "Points",
+	"webhooks":    "Webhooks",
+	"multipliers": "Multipliers",
+}
+
+// auditParamColumns maps a route parameter naming an entity to the column it is looked up by.
+var auditParamColumns = map[string]string{
+	"id":          "ID",
+	"external_id": "External_ID",
+}
+
+// auditTarget is the entity a route addresses: its name, table and how to find its row.
+type auditTarget struct {
+	entity string
+	table  string
+	column string
+	value  string
+}
+
+// auditTargetOf works out the entity addressed by a route, such as the student of "/api/v1/students/:id/points".
+// Legacy routes that create a house under "/houses/:id" address the tournament named by :id.
+func auditTargetOf(c *gin.Context) auditTarget {
+	route := strings.TrimPrefix(c.FullPath(), "/api/v1")
+	segments := strings.Split(strings.Trim(route, "/"), "/")
+	target := auditTarget{entity: segments[0], table: auditTables[segments[0]]}
+	if route == "/houses/:id" && c.Request.Method == http.MethodPost {
+		target.entity, target.table = "tournaments", "Tournaments"
+	}
+
+	// The entity's own parameter follows its name, possibly after "external"
+	rest := segments[1:]
+	if len(rest) > 0 && rest[0] == "external" {
+		rest = rest[1:]
+	}
+	if len(rest) > 0 && strings.HasPrefix(rest[0], ":") {
+		name := strings.TrimPrefix(rest[0], ":")
+		if column, ok := auditParamColumns[name]; ok {
+			target.column, target.value = column, c.Param(name)
+		}
+	}
+	return target
+}
+
+// auditRecorder copies a response so the body of a create can become its after snapshot.
+type auditRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditRecorder) Write(data []byte) (int, error) {
+	if w.body.Len() <= auditMaxResponse {
+		w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditRecorder) WriteString(s string) (int, error) {
+	if w.body.Len() <= auditMaxResponse {
+		w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Audit records every mutating request in the audit log: the actor, the route as the action, the entity it
+// addresses, the response status and JSON snapshots of the entity's row before and after the handler ran.
+// A create has no row before it, so its JSON response is kept as the after snapshot instead.
+// The actor is the one set under audit.ActorKey by the handler, else the X-Actor header.
+// Every request gets an X-Request-ID response header, reusing the request's own when it sends one.
+func Audit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" || len(requestID) > 64 {
+			requestID = audit.NewRequestID()
+		}
+		c.Header("X-Request-ID", requestID)
+
+		method := c.Request.Method
+		if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || c.FullPath() == "" {
+			c.Next()
+			return
+		}
+
+		db := config.ConnectToDB()
+		target := auditTargetOf(c)
+		var before json.RawMessage
+		if target.table != "" && target.value != "" {
+			var err error
+			if before, err = audit.Snapshot(db, target.table, target.column, target.value); err != nil {
+				log.Print("audit: ", err)
+			}
+		}
+
+		recorder := &auditRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		record := func(status int) {
+			entry := audit.Entry{
+				Request_ID:  requestID,
+				Actor:       c.GetHeader("X-Actor"),
+				Action:      method + " " + c.FullPath(),
+				Method:      method,
+				Path:        c.Request.URL.Path,
+				Entity:      target.entity,
+				Entity_ID:   target.value,
+				Status_Code: status,
+				Before:      before,
+				Client_IP:   c.ClientIP(),
+			}
+			if actor, ok := c.Get(audit.ActorKey); ok {
+				entry.Actor, _ = actor.(string)
+			}
+
+			if target.table != "" && target.value != "" {
+				var err error
+				if entry.After, err = audit.Snapshot(db, target.table, target.column, target.value); err != nil {
+					log.Print("audit: ", err)
+				}
+			} else if status < 300 && recorder.body.Len() <= auditMaxResponse {
+				entry.After = audit.Redact(recorder.body.Bytes())
+			}
+
+			if err := audit.Write(db, entry); err != nil {
+				log.Print("audit: ", err)
+			}
+		}
+
+		// A panicking handler still leaves a trace of the attempt
+		defer func() {
+			if r := recover(); r != nil {
+				record(http.StatusInternalServerError)
+				panic(r)
+			}
+		}()
+
+		c.Next()
+		record(c.Writer.Status())
+	}
+}
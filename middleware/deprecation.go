@@ -0,0 +1,30 @@
+// Package middleware provides gin middleware shared by the routes
+// of the house-cup application.
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deprecated marks a route as deprecated in favour of successor.
+// It sets the Deprecation header and a Link header pointing at the successor route,
+// filling in any ":name" segments of successor from the matched route's parameters,
+// then hands the request on to the original handler unchanged. When the route has no parameter
+// for a segment, such as a house ID the legacy route takes in its body, the Link header is left out
+// rather than advertising a placeholder.
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link := successor
+		for _, param := range c.Params {
+			link = strings.ReplaceAll(link, ":"+param.Key, param.Value)
+		}
+
+		c.Header("Deprecation", "true")
+		if !strings.Contains(link, "/:") {
+			c.Header("Link", "<"+link+">; rel=\"successor-version\"")
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,199 @@
+// Package middleware provides gin middleware shared by the routes
+// of the house-cup application.
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gambinish/house-cup/config"
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+)
+
+// defaultIdempotencyRetention is how long responses are kept when IDEMPOTENCY_RETENTION is not set.
+const defaultIdempotencyRetention = 24 * time.Hour
+
+// mysqlDuplicateEntry is the MySQL error number for a unique key violation.
+const mysqlDuplicateEntry = 1062
+
+// responseRecorder copies everything written to the client so it can be stored.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotencyRetention reads the IDEMPOTENCY_RETENTION duration (e.g. "24h") from the environment.
+func idempotencyRetention() time.Duration {
+	value := os.Getenv("IDEMPOTENCY_RETENTION")
+	if value == "" {
+		return defaultIdempotencyRetention
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil {
+		log.Print("invalid IDEMPOTENCY_RETENTION, using default: ", err)
+		return defaultIdempotencyRetention
+	}
+	return retention
+}
+
+// Idempotent honours the Idempotency-Key request header.
+// The first request with a given key runs the handler and its response is stored in Idempotency_Keys;
+// retries with the same key, method, path and body replay the stored response instead of running the handler again.
+// Reusing a key with a different body is rejected with 422, and a retry that arrives while the first request
+// is still running is rejected with 409. Server errors are not stored, so those requests can be retried.
+// Requests without the header are passed through unchanged.
+// The JSON fields named by redacted, such as secrets, are left out of the stored response, so replays omit them.
+func Idempotent(redacted ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("idempotency: %v", err)})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		method := c.Request.Method
+		path := c.Request.URL.Path
+		sum := sha256.Sum256(append([]byte(method+" "+path+"\n"), body...))
+		requestHash := hex.EncodeToString(sum[:])
+
+		db := config.ConnectToDB()
+
+		// Expired keys are purged lazily so they can be reused
+		_, err = db.Exec("DELETE FROM Idempotency_Keys WHERE Created_At < NOW() - INTERVAL ? SECOND", int64(idempotencyRetention().Seconds()))
+		if err != nil {
+			log.Print(err)
+		}
+
+		_, err = db.Exec("INSERT INTO Idempotency_Keys (Idempotency_Key, Method, Path, Request_Hash) VALUES (?, ?, ?, ?)", key, method, path, requestHash)
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+			replayResponse(c, db, key, method, path, requestHash)
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("idempotency: %v", err)})
+			return
+		}
+
+		forget := func() {
+			if _, err := db.Exec("DELETE FROM Idempotency_Keys WHERE Idempotency_Key = ? AND Method = ? AND Path = ?", key, method, path); err != nil {
+				log.Print(err)
+			}
+		}
+
+		// A panicking handler has not produced a response worth replaying
+		defer func() {
+			if r := recover(); r != nil {
+				forget()
+				panic(r)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError {
+			forget()
+			return
+		}
+
+		stored := recorder.body.Bytes()
+		if len(redacted) > 0 {
+			stored = redactJSON(stored, redacted)
+		}
+		_, err = db.Exec("UPDATE Idempotency_Keys SET Status_Code = ?, Content_Type = ?, Response_Body = ? WHERE Idempotency_Key = ? AND Method = ? AND Path = ?",
+			status, recorder.Header().Get("Content-Type"), string(stored), key, method, path)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// redactJSON returns body without the fields named by redacted, at any depth.
+// A body that is not JSON is not stored at all.
+func redactJSON(body []byte, redacted []string) []byte {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil
+	}
+	redactValue(value, redacted)
+	stripped, err := json.MarshalIndent(value, "", "    ")
+	if err != nil {
+		return nil
+	}
+	return stripped
+}
+
+// redactValue deletes the fields named by redacted from the objects within value.
+func redactValue(value interface{}, redacted []string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, field := range redacted {
+			delete(v, field)
+		}
+		for _, nested := range v {
+			redactValue(nested, redacted)
+		}
+	case []interface{}:
+		for _, nested := range v {
+			redactValue(nested, redacted)
+		}
+	}
+}
+
+// replayResponse answers a request whose idempotency key has already been used.
+func replayResponse(c *gin.Context, db *sql.DB, key string, method string, path string, requestHash string) {
+	var storedHash string
+	var status sql.NullInt64
+	var contentType, body sql.NullString
+
+	err := db.QueryRow("SELECT Request_Hash, Status_Code, Content_Type, Response_Body FROM Idempotency_Keys WHERE Idempotency_Key = ? AND Method = ? AND Path = ?",
+		key, method, path).Scan(&storedHash, &status, &contentType, &body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("idempotency: %v", err)})
+		return
+	}
+
+	if storedHash != requestHash {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+		return
+	}
+	if !status.Valid {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is still being processed"})
+		return
+	}
+
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(int(status.Int64), contentType.String, []byte(body.String))
+	c.Abort()
+}
@@ -1,10 +1,13 @@
 package models
 
+import "encoding/json"
+
 type Tournament struct {
 	ID              int64   `json:"id"`
 	Tournament_Name string  `json:"tournament_name"`
 	Created_At      string  `json:"created_at"`
 	Ended_At        *string `json:"ended_at"`
+	Version         int64   `json:"version"`
 }
 
 type House struct {
@@ -12,19 +15,114 @@ type House struct {
 	House_Name    string `json:"house_name"`
 	House_Points  int64  `json:"house_points"`
 	Tournament_ID int64  `json:"tournament_id"`
+	Version       int64  `json:"version"`
 }
 
 type Student struct {
-	ID           int64  `json:"id"`
-	Student_Name string `json:"student_name"`
-	Points       int64  `json:"points"`
-	House_ID     int64  `json:"house_id"`
+	ID              int64   `json:"id"`
+	Student_Name    string  `json:"student_name"`
+	Points          int64   `json:"points"`
+	House_ID        *int64  `json:"house_id"`
+	Version         int64   `json:"version"`
+	External_ID     *string `json:"external_id"`
+	Deleted_At      *string `json:"deleted_at"`
+	Deletion_Policy *string `json:"deletion_policy"`
 }
 
 type Point struct {
-	ID         int64  `json:"id"`
-	Points     int64  `json:"points"`
-	Notes      string `json:"notes"`
-	Student_ID *int64 `json:"student_id"`
-	House_ID   int64  `json:"house_id"`
+	ID             int64   `json:"id"`
+	Points         int64   `json:"points"`
+	Notes          string  `json:"notes"`
+	Student_ID     *int64  `json:"student_id"`
+	House_ID       int64   `json:"house_id"`
+	Created_At     string  `json:"created_at"`
+	Kind           string  `json:"kind"`
+	Reverses_ID    *int64  `json:"reverses_id"`
+	Raw_Points     int64   `json:"raw_points"`
+	Category       *string `json:"category"`
+	Multiplier_IDs *string `json:"multiplier_ids"`
+}
+
+type Multiplier struct {
+	ID              int64   `json:"id"`
+	Multiplier_Name string  `json:"multiplier_name"`
+	Factor          float64 `json:"factor"`
+	Tournament_ID   *int64  `json:"tournament_id"`
+	House_ID        *int64  `json:"house_id"`
+	Category        *string `json:"category"`
+	Starts_At       string  `json:"starts_at"`
+	Ends_At         string  `json:"ends_at"`
+	Created_At      string  `json:"created_at"`
+	Version         int64   `json:"version"`
+}
+
+type Achievement struct {
+	ID               int64  `json:"id"`
+	Student_ID       int64  `json:"student_id"`
+	Achievement_Key  string `json:"achievement_key"`
+	Achievement_Name string `json:"achievement_name"`
+	Point_ID         *int64 `json:"point_id"`
+	Granted_At       string `json:"granted_at"`
+}
+
+type Transfer struct {
+	ID             int64   `json:"id"`
+	Student_ID     int64   `json:"student_id"`
+	From_House_ID  int64   `json:"from_house_id"`
+	To_House_ID    int64   `json:"to_house_id"`
+	Policy         string  `json:"policy"`
+	Points_Moved   int64   `json:"points_moved"`
+	Notes          *string `json:"notes"`
+	Transferred_At string  `json:"transferred_at"`
+}
+
+type Enrollment struct {
+	ID            int64  `json:"id"`
+	Student_ID    int64  `json:"student_id"`
+	Tournament_ID int64  `json:"tournament_id"`
+	House_ID      int64  `json:"house_id"`
+	Points        int64  `json:"points"`
+	Enrolled_At   string `json:"enrolled_at"`
+}
+
+type Webhook struct {
+	ID          int64    `json:"id"`
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret,omitempty"`
+	Event_Types []string `json:"event_types"`
+	Active      bool     `json:"active"`
+	Created_At  string   `json:"created_at"`
+	Version     int64    `json:"version"`
+}
+
+type WebhookDelivery struct {
+	ID              int64   `json:"id"`
+	Webhook_ID      int64   `json:"webhook_id"`
+	Event_Type      string  `json:"event_type"`
+	Payload         string  `json:"payload"`
+	Status          string  `json:"status"`
+	Attempts        int64   `json:"attempts"`
+	Next_Attempt_At string  `json:"next_attempt_at"`
+	Last_Attempt_At *string `json:"last_attempt_at"`
+	Response_Status *int64  `json:"response_status"`
+	Last_Error      *string `json:"last_error"`
+	Delivered_At    *string `json:"delivered_at"`
+	Redelivery_Of   *int64  `json:"redelivery_of"`
+	Created_At      string  `json:"created_at"`
+}
+
+type AuditEntry struct {
+	ID          int64            `json:"id"`
+	Occurred_At string           `json:"occurred_at"`
+	Request_ID  string           `json:"request_id"`
+	Actor       string           `json:"actor"`
+	Action      string           `json:"action"`
+	Method      string           `json:"method"`
+	Path        string           `json:"path"`
+	Entity      string           `json:"entity"`
+	Entity_ID   *string          `json:"entity_id"`
+	Status_Code int64            `json:"status_code"`
+	Before      *json.RawMessage `json:"before"`
+	After       *json.RawMessage `json:"after"`
+	Client_IP   string           `json:"client_ip"`
 }
@@ -0,0 +1,41 @@
+// Package outbox makes the events of the house-cup application as durable as the changes they announce.
+// Handlers write events to the Outbox table inside the transaction making the change, and a Relay
+// publishes every committed entry to the configured sinks, such as the live event hub and webhooks.
+package outbox
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/gambinish/house-cup/events"
+)
+
+// Execer is satisfied by both *sql.DB and *sql.Tx.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Entry is a committed outbox row. Its Event carries the JSON data it was written with.
+type Entry struct {
+	ID         int64
+	Event      events.Event
+	Created_At time.Time
+}
+
+// Write adds events to the outbox. Call it inside the transaction making the change they announce,
+// so they are published exactly when that change commits, and call Notify on the relay afterwards.
+func Write(e Execer, changes ...events.Event) error {
+	for _, change := range changes {
+		data, err := json.Marshal(change.Data)
+		if err != nil {
+			return err
+		}
+		_, err = e.Exec("INSERT INTO Outbox (Event_Type, Tournament_ID, House_ID, Payload) VALUES (?, ?, ?, ?)",
+			change.Type, change.Tournament_ID, change.House_ID, string(data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Default relay settings.
+const (
+	defaultBatchSize    = 100
+	defaultPollInterval = time.Second
+	defaultRetention    = 24 * time.Hour
+	pruneInterval       = time.Hour
+)
+
+// Sink receives outbox entries in the order they were written.
+type Sink interface {
+	// Deliver handles a batch of entries within tx, the transaction that also records them as delivered
+	// to the sink. Sinks that keep their own state in the database write it through tx, so the entries
+	// and the record of their delivery commit together. An error rolls back both and the batch is retried.
+	Deliver(tx *sql.Tx, entries []Entry) error
+	// Committed is called with the entries once that transaction has committed. In-process sinks
+	// act here, so they never see an entry twice.
+	Committed(entries []Entry)
+}
+
+// registration is a sink known to a relay. Entries up to since are not relayed to it.
+type registration struct {
+	name  string
+	sink  Sink
+	local bool
+	since int64
+}
+
+// Relay publishes outbox entries to its sinks, exactly once per sink. Each delivery is recorded in
+// Outbox_Deliveries, keyed by entry and sink, in the transaction given to the sink, so relays running
+// in several application instances never deliver an entry to the same sink twice.
+type Relay struct {
+	BatchSize    int
+	PollInterval time.Duration
+	Retention    time.Duration
+
+	sinks []*registration
+	wake  chan struct{}
+}
+
+// Default is the relay started by the application and notified by its handlers.
+var Default = NewRelay()
+
+// NewRelay returns a relay without sinks. Retention is read from OUTBOX_RETENTION (e.g. "24h").
+func NewRelay() *Relay {
+	retention := defaultRetention
+	if value := os.Getenv("OUTBOX_RETENTION"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			log.Print("invalid OUTBOX_RETENTION, using default: ", err)
+		} else {
+			retention = parsed
+		}
+	}
+	return &Relay{BatchSize: defaultBatchSize, PollInterval: defaultPollInterval, Retention: retention, wake: make(chan struct{}, 1)}
+}
+
+// Register adds a sink that receives every entry not yet delivered to name, including entries
+// written while the application was down. Register sinks before calling Run.
+func (r *Relay) Register(name string, sink Sink) {
+	r.sinks = append(r.sinks, &registration{name: name, sink: sink})
+}
+
+// RegisterLocal adds an in-process sink, such as the live event hub, that every application instance needs
+// its own copy of. Its name is qualified with the host and process, and it only receives entries written after Run starts.
+func (r *Relay) RegisterLocal(name string, sink Sink) {
+	host, _ := os.Hostname()
+	r.sinks = append(r.sinks, &registration{name: fmt.Sprintf("%s@%s:%d", name, host, os.Getpid()), sink: sink, local: true})
+}
+
+// Notify wakes the relay to publish newly committed entries without waiting for its next poll.
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run relays entries until ctx is cancelled, polling every PollInterval and whenever it is notified.
+// Entries older than Retention are pruned once an hour.
+func (r *Relay) Run(ctx context.Context, db *sql.DB) {
+	var latest int64
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(ID), 0) FROM Outbox").Scan(&latest); err != nil {
+		log.Print("outbox: ", err)
+	}
+	for _, registration := range r.sinks {
+		if registration.local {
+			registration.since = latest
+		}
+	}
+
+	poll := time.NewTicker(r.PollInterval)
+	defer poll.Stop()
+	var pruned time.Time
+
+	for {
+		for _, registration := range r.sinks {
+			for {
+				relayed, err := r.relay(ctx, db, registration)
+				if err != nil {
+					log.Printf("outbox: %s: %v", registration.name, err)
+				}
+				// A full batch suggests more are waiting
+				if err != nil || relayed < r.BatchSize {
+					break
+				}
+			}
+		}
+
+		if time.Since(pruned) > pruneInterval {
+			if err := r.prune(db); err != nil {
+				log.Print("outbox: ", err)
+			}
+			pruned = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// relay delivers one batch of the entries not yet delivered to a sink and returns its size.
+func (r *Relay) relay(ctx context.Context, db *sql.DB, registration *registration) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT Outbox.ID, Outbox.Event_Type, Outbox.Tournament_ID, Outbox.House_ID, Outbox.Payload, Outbox.Created_At
+							FROM Outbox
+							LEFT JOIN Outbox_Deliveries ON Outbox_Deliveries.Outbox_ID = Outbox.ID AND Outbox_Deliveries.Sink = ?
+							WHERE Outbox.ID > ? AND Outbox_Deliveries.Outbox_ID IS NULL
+							ORDER BY Outbox.ID
+							LIMIT ?`, registration.name, registration.since, r.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var entries []Entry
+	for rows.Next() {
+		var entry Entry
+		var payload string
+		err := rows.Scan(&entry.ID, &entry.Event.Type, &entry.Event.Tournament_ID, &entry.Event.House_ID, &payload, &entry.Created_At)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		entry.Event.Data = json.RawMessage(payload)
+		entry.Event.Occurred_At = entry.Created_At.UTC().Format(time.RFC3339Nano)
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	// Claiming the entries first makes a concurrent relay of the same sink wait here and then fail
+	// on the duplicate key, rolling back anything it delivered
+	args := []interface{}{}
+	for _, entry := range entries {
+		args = append(args, entry.ID, registration.name)
+	}
+	_, err = tx.Exec("INSERT INTO Outbox_Deliveries (Outbox_ID, Sink) VALUES (?, ?)"+strings.Repeat(", (?, ?)", len(entries)-1), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := registration.sink.Deliver(tx, entries); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	registration.sink.Committed(entries)
+	return len(entries), nil
+}
+
+// prune deletes entries older than the retention period together with their delivery records.
+func (r *Relay) prune(db *sql.DB) error {
+	seconds := int64(r.Retention.Seconds())
+	_, err := db.Exec(`DELETE Outbox_Deliveries FROM Outbox_Deliveries
+						JOIN Outbox ON Outbox.ID = Outbox_Deliveries.Outbox_ID
+						WHERE Outbox.Created_At < NOW() - INTERVAL ? SECOND`, seconds)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM Outbox WHERE Created_At < NOW() - INTERVAL ? SECOND", seconds)
+	return err
+}
@@ -0,0 +1,106 @@
+package outbox
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gambinish/house-cup/events"
+	"github.com/gambinish/house-cup/webhooks"
+)
+
+// Sink names accepted in OUTBOX_SINKS.
+const (
+	HubSink     = "hub"
+	WebhookSink = "webhooks"
+	LogSink     = "log"
+)
+
+// defaultSinks are the sinks used when OUTBOX_SINKS is not set.
+var defaultSinks = []string{HubSink, WebhookSink}
+
+// hubSink publishes entries to a live event hub.
+type hubSink struct {
+	hub *events.Hub
+}
+
+func (s hubSink) Deliver(tx *sql.Tx, entries []Entry) error {
+	return nil
+}
+
+func (s hubSink) Committed(entries []Entry) {
+	published := make([]events.Event, 0, len(entries))
+	for _, entry := range entries {
+		published = append(published, entry.Event)
+	}
+	s.hub.Publish(published...)
+}
+
+// webhookTypes maps the event types that webhooks can subscribe to.
+var webhookTypes = map[string]string{
+	events.Award:              webhooks.PointsAwarded,
+	events.StudentDeleted:     webhooks.StudentDeleted,
+	events.TournamentEnded:    webhooks.TournamentEnded,
+	events.AchievementGranted: webhooks.AchievementGranted,
+}
+
+// webhookSink queues webhook deliveries for entries, in the relay's transaction, and wakes a dispatcher to send them.
+type webhookSink struct {
+	dispatcher *webhooks.Dispatcher
+}
+
+func (s webhookSink) Deliver(tx *sql.Tx, entries []Entry) error {
+	for _, entry := range entries {
+		eventType, ok := webhookTypes[entry.Event.Type]
+		if !ok {
+			continue
+		}
+		if _, err := webhooks.Enqueue(tx, eventType, entry.Created_At, entry.Event.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s webhookSink) Committed(entries []Entry) {
+	s.dispatcher.Notify()
+}
+
+// logSink writes one line per entry to the application log.
+type logSink struct{}
+
+func (logSink) Deliver(tx *sql.Tx, entries []Entry) error {
+	return nil
+}
+
+func (logSink) Committed(entries []Entry) {
+	for _, entry := range entries {
+		log.Printf("outbox: entry %d %s tournament=%d house=%d data=%s", entry.ID, entry.Event.Type, entry.Event.Tournament_ID, entry.Event.House_ID, entry.Event.Data)
+	}
+}
+
+// RegisterSinks registers the sinks named in OUTBOX_SINKS, a comma-separated list of hub, webhooks and log
+// that defaults to hub and webhooks, publishing to hub and sending through dispatcher.
+func (r *Relay) RegisterSinks(hub *events.Hub, dispatcher *webhooks.Dispatcher) error {
+	names := defaultSinks
+	if value := os.Getenv("OUTBOX_SINKS"); value != "" {
+		names = strings.Split(value, ",")
+	}
+
+	for _, name := range names {
+		switch name = strings.TrimSpace(name); name {
+		case HubSink:
+			r.RegisterLocal(name, hubSink{hub: hub})
+		case WebhookSink:
+			r.Register(name, webhookSink{dispatcher: dispatcher})
+		case LogSink:
+			r.Register(name, logSink{})
+		case "":
+		default:
+			return fmt.Errorf("unknown outbox sink %q, use %s, %s or %s", name, HubSink, WebhookSink, LogSink)
+		}
+	}
+	return nil
+}
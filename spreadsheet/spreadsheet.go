@@ -0,0 +1,122 @@
+// Package spreadsheet writes tabular exports of the house-cup application
+// row by row, as CSV or as a minimal single-sheet XLSX workbook, so that
+// large exports can be streamed to the client without buffering them.
+package spreadsheet
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Supported export formats.
+const (
+	CSV  = "csv"
+	XLSX = "xlsx"
+)
+
+// Writer streams the rows of a single table.
+// Integer values are written as numbers, nil values as empty cells and anything else as text.
+// CSV text starting with =, +, -, @, a tab or a carriage return is prefixed with a single quote so spreadsheet applications do not run it as a formula.
+type Writer interface {
+	// WriteRow appends one row to the table.
+	WriteRow(values ...interface{}) error
+	// Flush pushes buffered rows to the underlying writer.
+	Flush() error
+	// Close finishes the document. It does not close the underlying writer.
+	Close() error
+}
+
+// NewWriter returns a Writer producing format on w. sheet names the worksheet of XLSX documents.
+func NewWriter(w io.Writer, format string, sheet string) (Writer, error) {
+	switch format {
+	case CSV:
+		return &csvWriter{csv: csv.NewWriter(w)}, nil
+	case XLSX:
+		return newXLSXWriter(w, sheet)
+	default:
+		return nil, fmt.Errorf("unsupported format %q, use %q or %q", format, CSV, XLSX)
+	}
+}
+
+// ContentType returns the media type of format.
+func ContentType(format string) string {
+	if format == XLSX {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// integer returns the value of integer kinds written by the exports.
+func integer(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case *int64:
+		if v != nil {
+			return *v, true
+		}
+	}
+	return 0, false
+}
+
+// text formats a non-integer value as cell text.
+func text(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case *string:
+		if v == nil {
+			return ""
+		}
+		return *v
+	case *int64:
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatInt(*v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// neutralize prefixes text that spreadsheet applications would read as a formula with a single quote.
+func neutralize(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// csvWriter writes rows as RFC 4180 CSV.
+type csvWriter struct {
+	csv    *csv.Writer
+	record []string
+}
+
+func (w *csvWriter) WriteRow(values ...interface{}) error {
+	w.record = w.record[:0]
+	for _, value := range values {
+		if n, ok := integer(value); ok {
+			w.record = append(w.record, strconv.FormatInt(n, 10))
+		} else {
+			w.record = append(w.record, neutralize(text(value)))
+		}
+	}
+	return w.csv.Write(w.record)
+}
+
+func (w *csvWriter) Flush() error {
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+func (w *csvWriter) Close() error {
+	return w.Flush()
+}
@@ -0,0 +1,93 @@
+package spreadsheet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNeutralize(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"=SUM(A1:A2)", "'=SUM(A1:A2)"},
+		{"+1", "'+1"},
+		{"-5 for running", "'-5 for running"},
+		{"@cmd", "'@cmd"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+		{"Harry Potter", "Harry Potter"},
+		{"a=b", "a=b"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := neutralize(test.text); got != test.want {
+			t.Errorf("neutralize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestIntegerAndText(t *testing.T) {
+	n := int64(-7)
+	s := "Gryffindor"
+	var nilInt *int64
+	var nilString *string
+	tests := []struct {
+		value     interface{}
+		isInteger bool
+		integer   int64
+		text      string
+	}{
+		{42, true, 42, ""},
+		{int64(-3), true, -3, ""},
+		{&n, true, -7, ""},
+		{nilInt, false, 0, ""},
+		{"plain", false, 0, "plain"},
+		{&s, false, 0, "Gryffindor"},
+		{nilString, false, 0, ""},
+		{nil, false, 0, ""},
+		{true, false, 0, "true"},
+	}
+	for _, test := range tests {
+		got, ok := integer(test.value)
+		if ok != test.isInteger || got != test.integer {
+			t.Errorf("integer(%#v) = %d, %v, want %d, %v", test.value, got, ok, test.integer, test.isInteger)
+		}
+		if !ok {
+			if got := text(test.value); got != test.text {
+				t.Errorf("text(%#v) = %q, want %q", test.value, got, test.text)
+			}
+		}
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, CSV, "points")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int64(-5)
+	note := "=HYPERLINK(\"http://example.com\")"
+	var missing *string
+	if err := w.WriteRow("ID", "Points", "Notes", "House"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRow(1, &n, &note, missing); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "ID,Points,Notes,House\n1,-5,\"'=HYPERLINK(\"\"http://example.com\"\")\",\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewWriterRejectsUnknownFormats(t *testing.T) {
+	if _, err := NewWriter(&bytes.Buffer{}, "ods", "points"); err == nil {
+		t.Error("NewWriter accepted an unknown format")
+	}
+}
@@ -0,0 +1,96 @@
+package spreadsheet
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readEntry returns the content of the file called name in the zip archive data.
+func readEntry(t *testing.T, data []byte, name string) string {
+	t.Helper()
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range archive.File {
+		if file.Name != name {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	t.Fatalf("archive has no %s", name)
+	return ""
+}
+
+func TestXLSXWriteRow(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, XLSX, "points")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int64(-5)
+	var missing *int64
+	if err := w.WriteRow(1, &n, missing, "", "Tom & Jerry <3", "=1+1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sheet := readEntry(t, buf.Bytes(), "xl/worksheets/sheet1.xml")
+	want := `<row><c><v>1</v></c><c><v>-5</v></c><c/><c/>` +
+		`<c t="inlineStr"><is><t xml:space="preserve">Tom &amp; Jerry &lt;3</t></is></c>` +
+		`<c t="inlineStr"><is><t xml:space="preserve">=1+1</t></is></c></row>`
+	if !strings.Contains(sheet, want) {
+		t.Errorf("sheet %s does not contain %s", sheet, want)
+	}
+	if !strings.HasSuffix(sheet, xlsxSheetEnd) {
+		t.Errorf("sheet %s is not closed", sheet)
+	}
+}
+
+func TestXLSXSheetNameIsEscaped(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, XLSX, `Points & "Standings"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	workbook := readEntry(t, buf.Bytes(), "xl/workbook.xml")
+	if !strings.Contains(workbook, `<sheet name="Points &amp; &#34;Standings&#34;"`) {
+		t.Errorf("workbook %s does not hold the escaped sheet name", workbook)
+	}
+}
+
+func TestSheetName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"points", "points"},
+		{`a[b]c:d*e?f/g\h`, "a_b_c_d_e_f_g_h"},
+		{strings.Repeat("x", 40), strings.Repeat("x", 31)},
+		{strings.Repeat("é", 40), strings.Repeat("é", 31)},
+		{"", "Sheet1"},
+	}
+	for _, test := range tests {
+		if got := sheetName(test.name); got != test.want {
+			t.Errorf("sheetName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Default delivery settings of a Dispatcher.
+const (
+	defaultMaxAttempts  = 8
+	defaultBaseDelay    = 30 * time.Second
+	defaultMaxDelay     = time.Hour
+	defaultPollInterval = 10 * time.Second
+	defaultTimeout      = 10 * time.Second
+	defaultBatchSize    = 20
+	maxErrorLength      = 1024
+)
+
+// Dispatcher sends queued deliveries. A delivery that fails, by a transport error or a non-2xx response,
+// is retried after BaseDelay, doubling up to MaxDelay, until it has been attempted MaxAttempts times.
+// Deliveries are claimed with SKIP LOCKED, so several application instances may run dispatchers side by side.
+type Dispatcher struct {
+	Client       *http.Client
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	PollInterval time.Duration
+
+	wake chan struct{}
+}
+
+// Default is the dispatcher started by the application and notified by its handlers.
+var Default = NewDispatcher()
+
+// NewDispatcher returns a dispatcher with the default settings.
+// Its client only connects to Public addresses, so a host that resolves differently after registration still cannot reach the internal network.
+func NewDispatcher() *Dispatcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: defaultTimeout, Control: publicOnly}).DialContext
+	return &Dispatcher{
+		Client:       &http.Client{Timeout: defaultTimeout, Transport: transport},
+		MaxAttempts:  defaultMaxAttempts,
+		BaseDelay:    defaultBaseDelay,
+		MaxDelay:     defaultMaxDelay,
+		PollInterval: defaultPollInterval,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// publicOnly refuses connections to addresses that are not Public.
+func publicOnly(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !Public(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// Notify wakes the dispatcher to send newly queued deliveries without waiting for its next poll.
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries until ctx is cancelled, polling every PollInterval and whenever it is notified.
+func (d *Dispatcher) Run(ctx context.Context, db *sql.DB) {
+	poll := time.NewTicker(d.PollInterval)
+	defer poll.Stop()
+
+	for {
+		for {
+			sent, err := d.DeliverDue(ctx, db)
+			if err != nil {
+				log.Print("webhooks: ", err)
+			}
+			// A full batch suggests more are waiting
+			if err != nil || sent < defaultBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// due is a claimed delivery together with its webhook.
+type due struct {
+	id        int64
+	eventType string
+	payload   string
+	attempts  int
+	url       string
+	secret    string
+}
+
+// DeliverDue claims one batch of pending deliveries whose next attempt is due, sends them and records the outcomes.
+// It returns how many deliveries it attempted.
+func (d *Dispatcher) DeliverDue(ctx context.Context, db *sql.DB) (int, error) {
+	batch, err := d.claim(ctx, db)
+	if err != nil || len(batch) == 0 {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range batch {
+		wg.Add(1)
+		go func(delivery due) {
+			defer wg.Done()
+			status, err := d.Send(ctx, delivery.url, delivery.secret, delivery.id, delivery.eventType, []byte(delivery.payload))
+			if err := d.record(db, delivery, status, err); err != nil {
+				log.Print("webhooks: ", err)
+			}
+		}(delivery)
+	}
+	wg.Wait()
+	return len(batch), nil
+}
+
+// claim leases a batch of due deliveries by pushing their next attempt past the time it takes to send them,
+// so another dispatcher will not pick them up meanwhile and a dispatcher that dies leaves them to be retried.
+func (d *Dispatcher) claim(ctx context.Context, db *sql.DB) ([]due, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT Webhook_Deliveries.ID, Webhook_Deliveries.Event_Type, Webhook_Deliveries.Payload,
+								Webhook_Deliveries.Attempts, Webhooks.URL, Webhooks.Secret
+							FROM Webhook_Deliveries
+							JOIN Webhooks ON Webhooks.ID = Webhook_Deliveries.Webhook_ID
+							WHERE Webhook_Deliveries.Status = ? AND Webhook_Deliveries.Next_Attempt_At <= NOW() AND Webhooks.Active
+							ORDER BY Webhook_Deliveries.Next_Attempt_At, Webhook_Deliveries.ID
+							LIMIT ?
+							FOR UPDATE OF Webhook_Deliveries SKIP LOCKED`, Pending, defaultBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	var batch []due
+	var ids []interface{}
+	for rows.Next() {
+		var delivery due
+		if err := rows.Scan(&delivery.id, &delivery.eventType, &delivery.payload, &delivery.attempts, &delivery.url, &delivery.secret); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		batch = append(batch, delivery)
+		ids = append(ids, delivery.id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(batch) == 0 {
+		return nil, err
+	}
+
+	lease := seconds(2 * d.Client.Timeout)
+	if lease == 0 {
+		lease = seconds(2 * defaultTimeout)
+	}
+	args := append([]interface{}{lease}, ids...)
+	_, err = tx.Exec("UPDATE Webhook_Deliveries SET Next_Attempt_At = NOW() + INTERVAL ? SECOND WHERE ID IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	return batch, tx.Commit()
+}
+
+// Send posts one delivery to url, signed with secret. It returns the response status code,
+// and an error for a transport failure or a status outside 2xx.
+func (d *Dispatcher) Send(ctx context.Context, url string, secret string, deliveryID int64, eventType string, body []byte) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "house-cup-webhooks/1")
+	request.Header.Set(EventHeader, eventType)
+	request.Header.Set(DeliveryHeader, strconv.FormatInt(deliveryID, 10))
+	request.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	request.Header.Set(SignatureHeader, Sign(secret, now, body))
+
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("receiver answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// Backoff returns how long to wait before the next attempt of a delivery that has failed attempts times.
+func (d *Dispatcher) Backoff(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts && delay < d.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxDelay {
+		delay = d.MaxDelay
+	}
+	return delay
+}
+
+// record stores the outcome of an attempt: success ends the delivery, a failure schedules the
+// next attempt or, once MaxAttempts is reached, marks the delivery as failed.
+func (d *Dispatcher) record(db *sql.DB, delivery due, status int, sendErr error) error {
+	var responseStatus interface{}
+	if status > 0 {
+		responseStatus = status
+	}
+
+	if sendErr == nil {
+		_, err := db.Exec(`UPDATE Webhook_Deliveries
+							SET Status = ?, Attempts = Attempts + 1, Last_Attempt_At = NOW(), Response_Status = ?, Last_Error = NULL, Delivered_At = NOW()
+							WHERE ID = ?`, Succeeded, responseStatus, delivery.id)
+		return err
+	}
+
+	message := sendErr.Error()
+	if len(message) > maxErrorLength {
+		message = message[:maxErrorLength]
+	}
+	attempts := delivery.attempts + 1
+	if attempts >= d.MaxAttempts {
+		_, err := db.Exec(`UPDATE Webhook_Deliveries
+							SET Status = ?, Attempts = ?, Last_Attempt_At = NOW(), Response_Status = ?, Last_Error = ?
+							WHERE ID = ?`, Failed, attempts, responseStatus, message, delivery.id)
+		return err
+	}
+	_, err := db.Exec(`UPDATE Webhook_Deliveries
+						SET Attempts = ?, Last_Attempt_At = NOW(), Response_Status = ?, Last_Error = ?, Next_Attempt_At = NOW() + INTERVAL ? SECOND
+						WHERE ID = ?`, attempts, responseStatus, message, seconds(d.Backoff(attempts)), delivery.id)
+	return err
+}
+
+// seconds rounds a duration up to whole seconds for use in an SQL interval.
+func seconds(duration time.Duration) int64 {
+	return int64((duration + time.Second - 1) / time.Second)
+}
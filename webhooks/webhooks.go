@@ -0,0 +1,133 @@
+// Package webhooks delivers signed JSON notifications of house-cup events to registered URLs.
+// Deliveries are queued in the Webhook_Deliveries table, so they survive restarts, and are sent
+// asynchronously by a Dispatcher that retries failures with exponential backoff.
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types that webhooks can subscribe to.
+const (
+	// PointsAwarded is sent for every new points record.
+	PointsAwarded = "points.awarded"
+	// StudentDeleted is sent when a student is deleted.
+	StudentDeleted = "student.deleted"
+	// TournamentEnded is sent when a tournament is given an end date.
+	TournamentEnded = "tournament.ended"
+	// AchievementGranted is sent when a student earns an achievement.
+	AchievementGranted = "achievement.granted"
+)
+
+// Types lists every event type, in the order they are documented.
+var Types = []string{PointsAwarded, StudentDeleted, TournamentEnded, AchievementGranted}
+
+// Delivery statuses.
+const (
+	Pending   = "pending"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+)
+
+// Headers sent with every delivery.
+const (
+	EventHeader     = "X-House-Cup-Event"
+	DeliveryHeader  = "X-House-Cup-Delivery"
+	TimestampHeader = "X-House-Cup-Timestamp"
+	SignatureHeader = "X-House-Cup-Signature"
+)
+
+// Execer is satisfied by both *sql.DB and *sql.Tx.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Payload is the JSON body of a delivery.
+type Payload struct {
+	Type        string      `json:"type"`
+	Occurred_At string      `json:"occurred_at"`
+	Data        interface{} `json:"data"`
+}
+
+// KnownType reports whether eventType is one of Types.
+func KnownType(eventType string) bool {
+	for _, known := range Types {
+		if known == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Enqueue queues one delivery of an event that occurred at occurredAt for every active webhook subscribed to its type.
+// Call it inside a transaction, so the deliveries exist exactly when it commits, and call Notify on the
+// dispatcher afterwards. It returns how many deliveries were queued.
+func Enqueue(e Execer, eventType string, occurredAt time.Time, data interface{}) (int64, error) {
+	body, err := json.Marshal(Payload{Type: eventType, Occurred_At: occurredAt.UTC().Format(time.RFC3339), Data: data})
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := e.Exec(`INSERT INTO Webhook_Deliveries (Webhook_ID, Event_Type, Payload)
+							SELECT ID, ?, ? FROM Webhooks
+							WHERE Active AND (Event_Types IS NULL OR FIND_IN_SET(?, Event_Types))`, eventType, string(body), eventType)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Sign returns the signature header value of a delivery body sent at timestamp:
+// "sha256=" followed by the hex HMAC-SHA256, keyed with the webhook's secret, of the
+// timestamp, a period and the body. Receivers recompute it to check the delivery is authentic
+// and reject stale timestamps to prevent replays.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the valid signature of body sent at the Unix timestamp given as text.
+func Verify(secret string, timestamp string, body []byte, signature string) bool {
+	unix, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+	if err != nil {
+		return false
+	}
+	expected := Sign(secret, time.Unix(unix, 0), body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// ErrPrivateAddress reports a webhook URL that points inside the network the application runs in.
+var ErrPrivateAddress = errors.New("webhook URLs must not point at loopback, link-local or private addresses")
+
+// Public reports whether ip may receive deliveries: it must not be a loopback, link-local, private or unspecified address.
+func Public(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified())
+}
+
+// CheckHost resolves the host of a webhook URL and returns ErrPrivateAddress when any of its addresses is not Public.
+func CheckHost(host string) error {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve host %q", host)
+	}
+	for _, ip := range ips {
+		if !Public(ip) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
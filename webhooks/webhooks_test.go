@@ -0,0 +1,211 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"type":"points.awarded"}`)
+	sent := time.Unix(1700000000, 0)
+	signature := Sign("secret", sent, body)
+	timestamp := strconv.FormatInt(sent.Unix(), 10)
+
+	if !Verify("secret", timestamp, body, signature) {
+		t.Fatal("Verify rejected a valid signature")
+	}
+	if Verify("other", timestamp, body, signature) {
+		t.Error("Verify accepted a signature made with another secret")
+	}
+	if Verify("secret", timestamp, []byte(`{"type":"student.deleted"}`), signature) {
+		t.Error("Verify accepted a tampered body")
+	}
+	if Verify("secret", strconv.FormatInt(sent.Unix()+1, 10), body, signature) {
+		t.Error("Verify accepted another timestamp")
+	}
+	if Verify("secret", "not a timestamp", body, signature) {
+		t.Error("Verify accepted an invalid timestamp")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{BaseDelay: 30 * time.Second, MaxDelay: time.Hour}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, test := range tests {
+		if got := d.Backoff(test.attempts); got != test.want {
+			t.Errorf("Backoff(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+// receivedDelivery is a delivery as seen by a test receiver.
+type receivedDelivery struct {
+	deliveryID string
+	eventType  string
+	body       string
+	verified   bool
+}
+
+func TestSendRetriesAndRedelivers(t *testing.T) {
+	var mu sync.Mutex
+	var received []receivedDelivery
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, receivedDelivery{
+			deliveryID: r.Header.Get(DeliveryHeader),
+			eventType:  r.Header.Get(EventHeader),
+			body:       string(body),
+			verified:   Verify("secret", r.Header.Get(TimestampHeader), body, r.Header.Get(SignatureHeader)),
+		})
+		// Fail the first attempt to exercise a retry
+		if len(received) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	d := NewDispatcher()
+	d.Client = server.Client()
+	body := []byte(`{"type":"points.awarded","data":{"points":10}}`)
+
+	status, err := d.Send(context.Background(), server.URL, "secret", 1, PointsAwarded, body)
+	if err == nil || status != http.StatusInternalServerError {
+		t.Fatalf("first attempt: got status %d and error %v, want 500 and an error", status, err)
+	}
+	status, err = d.Send(context.Background(), server.URL, "secret", 1, PointsAwarded, body)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("retry: got status %d and error %v, want 204", status, err)
+	}
+	// A redelivery is a new delivery of the same payload
+	status, err = d.Send(context.Background(), server.URL, "secret", 2, PointsAwarded, body)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("redelivery: got status %d and error %v, want 204", status, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 3 {
+		t.Fatalf("receiver got %d requests, want 3", len(received))
+	}
+	wantIDs := []string{"1", "1", "2"}
+	for i, delivery := range received {
+		if !delivery.verified {
+			t.Errorf("request %d: signature did not verify", i)
+		}
+		if delivery.body != string(body) || delivery.eventType != PointsAwarded {
+			t.Errorf("request %d: got %s %s, want %s %s", i, delivery.eventType, delivery.body, PointsAwarded, body)
+		}
+		if delivery.deliveryID != wantIDs[i] {
+			t.Errorf("request %d: delivery ID %s, want %s", i, delivery.deliveryID, wantIDs[i])
+		}
+	}
+}
+
+func TestDefaultClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a delivery reached a loopback receiver")
+	}))
+	defer server.Close()
+
+	_, err := NewDispatcher().Send(context.Background(), server.URL, "secret", 1, PointsAwarded, []byte(`{}`))
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("got error %v, want ErrPrivateAddress", err)
+	}
+}
+
+func TestPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:192.168.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"93.184.216.34", true},
+		{"::ffff:93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+	}
+	for _, test := range tests {
+		if got := Public(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("Public(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want error
+	}{
+		{"127.0.0.1", ErrPrivateAddress},
+		{"::1", ErrPrivateAddress},
+		{"10.0.0.1", ErrPrivateAddress},
+		{"172.31.255.255", ErrPrivateAddress},
+		{"192.168.1.1", ErrPrivateAddress},
+		{"169.254.169.254", ErrPrivateAddress},
+		{"fe80::1", ErrPrivateAddress},
+		{"::ffff:127.0.0.1", ErrPrivateAddress},
+		{"::ffff:169.254.169.254", ErrPrivateAddress},
+		{"93.184.216.34", nil},
+	}
+	for _, test := range tests {
+		if err := CheckHost(test.host); !errors.Is(err, test.want) {
+			t.Errorf("CheckHost(%s) = %v, want %v", test.host, err, test.want)
+		}
+	}
+}
+
+func TestPublicOnlyRefusesPrivateDials(t *testing.T) {
+	tests := []struct {
+		address string
+		want    error
+	}{
+		{"127.0.0.1:80", ErrPrivateAddress},
+		{"[::1]:443", ErrPrivateAddress},
+		{"10.1.2.3:8080", ErrPrivateAddress},
+		{"192.168.0.10:80", ErrPrivateAddress},
+		{"169.254.169.254:80", ErrPrivateAddress},
+		{"[fe80::1]:80", ErrPrivateAddress},
+		{"[::ffff:127.0.0.1]:80", ErrPrivateAddress},
+		{"[::ffff:10.0.0.1]:80", ErrPrivateAddress},
+		{"93.184.216.34:443", nil},
+	}
+	for _, test := range tests {
+		if err := publicOnly("tcp", test.address, nil); !errors.Is(err, test.want) {
+			t.Errorf("publicOnly(%s) = %v, want %v", test.address, err, test.want)
+		}
+	}
+}